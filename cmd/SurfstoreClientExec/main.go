@@ -5,19 +5,79 @@ import (
 	"flag"
 	"fmt"
 	"io/ioutil"
-	"log"
 	"os"
+	"os/signal"
 	"strconv"
+	"strings"
+	"syscall"
 )
 
 // Arguments
 const ARG_COUNT int = 3
 
+// Environment variables holding the default token and passphrase
+const TOKEN_ENV = "SURFSTORE_TOKEN"
+const PASSPHRASE_ENV = "SURFSTORE_PASSPHRASE"
+
 // Usage strings
-const USAGE_STRING = "./run-client.sh -d host:port baseDir blockSize"
+const USAGE_STRING = "./run-client.sh -d -logLevel level -logJSON -atomic -rehash -dry-run -json -ca file -cert file -key file -serverName name -token token -passphraseFile file -compress=false -uploadLimit bytes -downloadLimit bytes -limitsFile file -retries n -progress=false host:port baseDir blockSize"
 
 const DEBUG_NAME = "d"
-const DEBUG_USAGE = "Output log statements"
+const DEBUG_USAGE = "Output debug log statements, same as -logLevel debug"
+
+const LOG_LEVEL_NAME = "logLevel"
+const LOG_LEVEL_USAGE = "(default = warn) Least severe log level to output: debug, info, warn or error"
+
+const LOG_JSON_NAME = "logJSON"
+const LOG_JSON_USAGE = "Output log lines as JSON objects"
+
+const ATOMIC_NAME = "atomic"
+const ATOMIC_USAGE = "Commit all changes of a sync in one all-or-nothing transaction"
+
+const REHASH_NAME = "rehash"
+const REHASH_USAGE = "Rehash every file instead of trusting unchanged size, mtime and inode"
+
+const DRY_RUN_NAME = "dry-run"
+const DRY_RUN_USAGE = "Print the sync plan without changing the base directory or the server"
+
+const JSON_NAME = "json"
+const JSON_USAGE = "Print the dry-run plan as JSON"
+
+const CERT_NAME = "cert"
+const CERT_USAGE = "Client certificate file for mutual TLS"
+
+const KEY_NAME = "key"
+const KEY_USAGE = "Client private key file for mutual TLS"
+
+const CA_NAME = "ca"
+const CA_USAGE = "CA file used to verify the servers, enables TLS"
+
+const SERVER_NAME_NAME = "serverName"
+const SERVER_NAME_USAGE = "Name to verify server certificates against instead of the dialed host"
+
+const TOKEN_NAME = "token"
+const TOKEN_USAGE = "Token identifying the user to the MetaStore, defaults to $" + TOKEN_ENV
+
+const PASSPHRASE_NAME = "passphraseFile"
+const PASSPHRASE_USAGE = "File with the passphrase to encrypt blocks and filenames with, defaults to $" + PASSPHRASE_ENV
+
+const COMPRESS_NAME = "compress"
+const COMPRESS_USAGE = "(default = true) Gzip block transfers that compress well"
+
+const UPLOAD_LIMIT_NAME = "uploadLimit"
+const UPLOAD_LIMIT_USAGE = "Most block bytes to upload per second, 0 for no limit"
+
+const DOWNLOAD_LIMIT_NAME = "downloadLimit"
+const DOWNLOAD_LIMIT_USAGE = "Most block bytes to download per second, 0 for no limit"
+
+const LIMITS_FILE_NAME = "limitsFile"
+const LIMITS_FILE_USAGE = "File with upload,<bytes> and download,<bytes> lines replacing the limits above; send SIGHUP to reload it during a sync"
+
+const RETRIES_NAME = "retries"
+const RETRIES_USAGE = "(default = 20) Most retries of calls that failed transiently, across the whole sync; 0 to never retry"
+
+const PROGRESS_NAME = "progress"
+const PROGRESS_USAGE = "(default = true) Report sync progress on stdout, as a bar on a terminal and as JSON lines otherwise"
 
 const ADDR_NAME = "host:port"
 const ADDR_USAGE = "IP address and port of the MetaStore the client is syncing to"
@@ -30,6 +90,13 @@ const BLOCK_USAGE = "Size of the blocks used to fragment files"
 
 // Exit codes
 const EX_USAGE int = 64
+const EX_DATAERR int = 65 // the server rejected a request as invalid, e.g. a block over its size limit
+const EX_SOFTWARE int = 70
+const EX_UNAVAILABLE int = 69 // network or server failure
+const EX_CANTCREAT int = 73   // the server's quota or rate limit was exceeded
+const EX_IOERR int = 74       // local file system failure
+const EX_CONFLICT int = 75    // the server had newer versions; syncing again picks them up
+const EX_NOPERM int = 77      // the MetaStore refused the token or a change to a file
 
 func main() {
 	// Custom flag Usage message
@@ -37,19 +104,55 @@ func main() {
 		w := flag.CommandLine.Output()
 		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
 		fmt.Fprintf(w, "  -%s: %v\n", DEBUG_NAME, DEBUG_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", LOG_LEVEL_NAME, LOG_LEVEL_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", LOG_JSON_NAME, LOG_JSON_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", ATOMIC_NAME, ATOMIC_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", REHASH_NAME, REHASH_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", DRY_RUN_NAME, DRY_RUN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", JSON_NAME, JSON_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CERT_NAME, CERT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", KEY_NAME, KEY_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", CA_NAME, CA_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", SERVER_NAME_NAME, SERVER_NAME_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", TOKEN_NAME, TOKEN_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PASSPHRASE_NAME, PASSPHRASE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", COMPRESS_NAME, COMPRESS_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", UPLOAD_LIMIT_NAME, UPLOAD_LIMIT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", DOWNLOAD_LIMIT_NAME, DOWNLOAD_LIMIT_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", LIMITS_FILE_NAME, LIMITS_FILE_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", RETRIES_NAME, RETRIES_USAGE)
+		fmt.Fprintf(w, "  -%s: %v\n", PROGRESS_NAME, PROGRESS_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", ADDR_NAME, ADDR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BASEDIR_NAME, BASEDIR_USAGE)
 		fmt.Fprintf(w, "  %s: %v\n", BLOCK_NAME, BLOCK_USAGE)
 	}
 
 	// Parse command-line arguments and flags
-	debug := flag.Bool("d", false, DEBUG_USAGE)
+	debug := flag.Bool(DEBUG_NAME, false, DEBUG_USAGE)
+	logLevel := flag.String(LOG_LEVEL_NAME, surfstore.LOG_WARN, LOG_LEVEL_USAGE)
+	logJSON := flag.Bool(LOG_JSON_NAME, false, LOG_JSON_USAGE)
+	atomic := flag.Bool(ATOMIC_NAME, false, ATOMIC_USAGE)
+	rehash := flag.Bool(REHASH_NAME, false, REHASH_USAGE)
+	dryRun := flag.Bool(DRY_RUN_NAME, false, DRY_RUN_USAGE)
+	planJSON := flag.Bool(JSON_NAME, false, JSON_USAGE)
+	certFile := flag.String(CERT_NAME, "", CERT_USAGE)
+	keyFile := flag.String(KEY_NAME, "", KEY_USAGE)
+	caFile := flag.String(CA_NAME, "", CA_USAGE)
+	serverName := flag.String(SERVER_NAME_NAME, "", SERVER_NAME_USAGE)
+	token := flag.String(TOKEN_NAME, os.Getenv(TOKEN_ENV), TOKEN_USAGE)
+	passphraseFile := flag.String(PASSPHRASE_NAME, "", PASSPHRASE_USAGE)
+	compress := flag.Bool(COMPRESS_NAME, true, COMPRESS_USAGE)
+	uploadLimit := flag.Int64(UPLOAD_LIMIT_NAME, 0, UPLOAD_LIMIT_USAGE)
+	downloadLimit := flag.Int64(DOWNLOAD_LIMIT_NAME, 0, DOWNLOAD_LIMIT_USAGE)
+	limitsFile := flag.String(LIMITS_FILE_NAME, "", LIMITS_FILE_USAGE)
+	retries := flag.Int(RETRIES_NAME, surfstore.DEFAULT_RETRY_BUDGET, RETRIES_USAGE)
+	progress := flag.Bool(PROGRESS_NAME, true, PROGRESS_USAGE)
 	flag.Parse()
 
 	// Use tail arguments to hold non-flag arguments
 	args := flag.Args()
 
-	if len(args) != ARG_COUNT {
+	if len(args) != ARG_COUNT || *uploadLimit < 0 || *downloadLimit < 0 || *retries < 0 {
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
@@ -62,12 +165,126 @@ func main() {
 		os.Exit(EX_USAGE)
 	}
 
-	// Disable log outputs if debug flag is missing
-	if !(*debug) {
-		log.SetFlags(0)
-		log.SetOutput(ioutil.Discard)
+	// Logs go to stderr, stdout is left to the dry-run plan and the progress reports
+	if *debug {
+		*logLevel = surfstore.LOG_DEBUG
 	}
+	logger, err := surfstore.NewLogger(os.Stderr, *logLevel, *logJSON)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_USAGE)
+	}
+	surfstore.SetDefaultLogger(logger)
 
 	rpcClient := surfstore.NewSurfstoreRPCClient(hostPort, baseDir, blockSize)
-	surfstore.ClientSync(rpcClient)
+	rpcClient.Atomic = *atomic
+	rpcClient.Rehash = *rehash
+	rpcClient.DryRun = *dryRun
+	rpcClient.PlanJSON = *planJSON
+
+	creds, err := surfstore.NewClientCredentials(&surfstore.TLSConfig{
+		CertFile:   *certFile,
+		KeyFile:    *keyFile,
+		CAFile:     *caFile,
+		ServerName: *serverName,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "TLS setup failed: %v\n", err)
+		os.Exit(EX_USAGE)
+	}
+	rpcClient.Credentials = creds
+	rpcClient.Token = *token
+	rpcClient.Compress = *compress
+	rpcClient.Retry = surfstore.NewRetryPolicy(*retries)
+	if *limitsFile != "" {
+		limits, err := surfstore.LoadTransferLimits(*limitsFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading limits failed: %v\n", err)
+			os.Exit(EX_USAGE)
+		}
+		// Both throttles exist so a reload can limit a direction that had no limit
+		rpcClient.UploadThrottle = surfstore.NewThrottle(limits.Upload)
+		rpcClient.DownloadThrottle = surfstore.NewThrottle(limits.Download)
+		reloadLimits(*limitsFile, rpcClient.UploadThrottle, rpcClient.DownloadThrottle)
+	} else {
+		if *uploadLimit > 0 {
+			rpcClient.UploadThrottle = surfstore.NewThrottle(*uploadLimit)
+		}
+		if *downloadLimit > 0 {
+			rpcClient.DownloadThrottle = surfstore.NewThrottle(*downloadLimit)
+		}
+	}
+	// A dry run changes nothing, its plan is all there is to report
+	if *progress && !*dryRun {
+		if isTerminal(os.Stdout) {
+			rpcClient.Progress = surfstore.NewProgressBar(os.Stdout)
+		} else {
+			rpcClient.Progress = surfstore.NewProgressJSON(os.Stdout)
+		}
+	}
+	rpcClient.Passphrase = os.Getenv(PASSPHRASE_ENV)
+	if *passphraseFile != "" {
+		passphrase, err := ioutil.ReadFile(*passphraseFile)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "reading passphrase failed: %v\n", err)
+			os.Exit(EX_USAGE)
+		}
+		rpcClient.Passphrase = strings.TrimRight(string(passphrase), "\r\n")
+	}
+
+	result, err := surfstore.ClientSync(rpcClient)
+	if err == nil {
+		return
+	}
+	if result != nil {
+		for _, file := range result.Failed() {
+			fmt.Fprintf(os.Stderr, "%s %s: %v\n", file.Action, file.Filename, file.Err)
+		}
+	}
+	fmt.Fprintf(os.Stderr, "sync failed: %v\n", err)
+	os.Exit(exitCode(err))
+}
+
+// reloadLimits applies the limits file to the throttles of the running sync
+// whenever the client gets SIGHUP, keeping the current limits if it is invalid
+func reloadLimits(path string, upload *surfstore.Throttle, download *surfstore.Throttle) {
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			limits, err := surfstore.LoadTransferLimits(path)
+			if err != nil {
+				surfstore.DefaultLogger().Error("reloading limits failed, keeping the current ones", "error", err)
+				continue
+			}
+			upload.SetRate(limits.Upload)
+			download.SetRate(limits.Download)
+			surfstore.DefaultLogger().Info("limits reloaded", "upload", limits.Upload, "download", limits.Download)
+		}
+	}()
+}
+
+// isTerminal reports whether a file is a terminal rather than a pipe or a regular file
+func isTerminal(file *os.File) bool {
+	info, err := file.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// exitCode maps the most severe sync error to a distinct exit code
+func exitCode(err error) int {
+	switch surfstore.ErrorKind(err) {
+	case surfstore.ERR_NETWORK:
+		return EX_UNAVAILABLE
+	case surfstore.ERR_LOCAL_IO:
+		return EX_IOERR
+	case surfstore.ERR_CONFLICT:
+		return EX_CONFLICT
+	case surfstore.ERR_AUTH, surfstore.ERR_PERMISSION:
+		return EX_NOPERM
+	case surfstore.ERR_INVALID:
+		return EX_DATAERR
+	case surfstore.ERR_LIMIT:
+		return EX_CANTCREAT
+	}
+	return EX_SOFTWARE
 }
@@ -4,26 +4,37 @@ import (
 	"cse224/proj4/pkg/surfstore"
 	"flag"
 	"fmt"
-	"io/ioutil"
-	"log"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"sort"
 	"strconv"
 	"strings"
+	"syscall"
+	"time"
 
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
 )
 
 // Usage String
-const USAGE_STRING = "./run-server.sh -s <service_type> -p <port> -l -d (blockStoreAddr*)"
-
-// Set of valid services
-var SERVICE_TYPES = map[string]bool{"meta": true, "block": true, "both": true}
+const USAGE_STRING = "./run-server.sh -config <file> -s <service_type> -p <port> -l -d -logLevel <level> -logJSON -cert <file> -key <file> -ca <file> -clientAuth -users <file> -blockDir <dir> -blockKeyFile <file> -metrics <addr> -shutdownTimeout <duration> -maxBlockSize <bytes> -maxMessageSize <bytes> -quota <blocks> -blockRate <calls/s> -blockBurst <calls> (blockStoreAddr*)"
+const ADMIN_USAGE_STRING = "./run-server.sh admin -keyFile <file> newkey <id> | admin -users <file> adduser <name> [namespace] | deluser <name> | token <name> | revoke <token> | promote <name> | demote <name> | quota <namespace> <blocks> | share [-read users] [-write users] <owner> <prefix> | unshare <prefix> | list"
 
 // Exit codes
 const EX_USAGE int = 64
 
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "admin" {
+		if err := runAdmin(os.Args[2:]); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(EX_USAGE)
+		}
+		return
+	}
+
 	// Custom flag Usage message
 	flag.Usage = func() {
 		w := flag.CommandLine.Output()
@@ -34,60 +45,447 @@ func main() {
 		fmt.Fprintf(w, "  (blockStoreAddr*): BlockStore Address (include self if service type is both)\n")
 	}
 
-	// Parse command-line argument flags
-	service := flag.String("s", "", "(required) Service Type of the Server: meta, block, both")
-	port := flag.Int("p", 8080, "(default = 8080) Port to accept connections")
-	localOnly := flag.Bool("l", false, "Only listen on localhost")
-	debug := flag.Bool("d", false, "Output log statements")
+	// Parse command-line argument flags. They fill in the config, over the config file's values.
+	config := surfstore.DefaultServerConfig()
+	configFile := flag.String("config", "", "YAML config file; flags given on the command line override its values")
+	flag.StringVar(&config.Service, "s", config.Service, "(required) Service Type of the Server: meta, block, both")
+	flag.IntVar(&config.Port, "p", config.Port, "(default = 8080) Port to accept connections")
+	flag.BoolVar(&config.LocalOnly, "l", config.LocalOnly, "Only listen on localhost")
+	debug := flag.Bool("d", false, "Output debug log statements, same as -logLevel debug")
+	flag.StringVar(&config.Log.Level, "logLevel", config.Log.Level, "(default = info) Least severe log level to output: debug, info, warn or error")
+	flag.BoolVar(&config.Log.JSON, "logJSON", config.Log.JSON, "Output log lines as JSON objects")
+	flag.StringVar(&config.TLS.CertFile, "cert", config.TLS.CertFile, "TLS certificate file, enables TLS together with -key")
+	flag.StringVar(&config.TLS.KeyFile, "key", config.TLS.KeyFile, "TLS private key file")
+	flag.StringVar(&config.TLS.CAFile, "ca", config.TLS.CAFile, "CA file used to verify client certificates")
+	flag.BoolVar(&config.TLS.RequireClientCert, "clientAuth", config.TLS.RequireClientCert, "Require clients to present a certificate signed by -ca (mutual TLS)")
+	flag.StringVar(&config.UsersFile, "users", config.UsersFile, "Users file; when set every MetaStore and Admin call needs a token and users only see their namespace")
+	flag.StringVar(&config.BlockStorage.Dir, "blockDir", config.BlockStorage.Dir, "Directory to keep blocks in, in memory if not set")
+	flag.StringVar(&config.BlockStorage.KeyFile, "blockKeyFile", config.BlockStorage.KeyFile, "Key file to encrypt stored blocks with; send SIGHUP after adding a key to re-encrypt every block with it")
+	flag.StringVar(&config.MetricsAddr, "metrics", config.MetricsAddr, "Address to serve Prometheus metrics on at /metrics, e.g. localhost:9100")
+	flag.DurationVar(&config.TombstoneRetention, "tombstoneRetention", config.TombstoneRetention, "(default = 168h) How long deleted files are remembered before they can be purged, 0 to keep forever")
+	flag.DurationVar(&config.ShutdownTimeout, "shutdownTimeout", config.ShutdownTimeout, "(default = 30s) How long SIGTERM waits for requests in flight before stopping anyway")
+	flag.IntVar(&config.Limits.MaxBlockSize, "maxBlockSize", config.Limits.MaxBlockSize, "(default = 4194304) Largest block in bytes the BlockStore accepts")
+	flag.IntVar(&config.Limits.MaxMessageSize, "maxMessageSize", config.Limits.MaxMessageSize, "(default = 16777216) Largest request in bytes the server accepts")
+	flag.IntVar(&config.Limits.Quota, "quota", config.Limits.Quota, "Distinct blocks the files of a namespace may reference, 0 for no limit; the users file can give namespaces their own")
+	flag.Float64Var(&config.Limits.BlockRate, "blockRate", config.Limits.BlockRate, "BlockStore calls per second each client host may make, 0 for no limit")
+	flag.IntVar(&config.Limits.BlockBurst, "blockBurst", config.Limits.BlockBurst, "(default = 100) BlockStore calls a client host may make at once with -blockRate")
 	flag.Parse()
 
 	// Use tail arguments to hold BlockStore address
 	args := flag.Args()
-	blockStoreAddr := ""
-	if len(args) == 1 {
-		blockStoreAddr = args[0]
+	if len(args) > 1 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+
+	// Every load starts from the defaults and the file, then puts the command line back on top
+	commandLine := make(map[string]string)
+	flag.Visit(func(f *flag.Flag) {
+		commandLine[f.Name] = f.Value.String()
+	})
+	load := func() (*surfstore.ServerConfig, error) {
+		*config = *surfstore.DefaultServerConfig()
+		if *configFile != "" {
+			if err := config.Load(*configFile); err != nil {
+				return nil, err
+			}
+		}
+		for name, value := range commandLine {
+			flag.Set(name, value)
+		}
+		if *debug {
+			config.Log.Level = surfstore.LOG_DEBUG
+		}
+		if len(args) == 1 {
+			config.BlockStoreAddr = args[0]
+		}
+		if err := config.Validate(); err != nil {
+			return nil, err
+		}
+		loaded := *config
+		return &loaded, nil
 	}
 
-	// Valid service type argument
-	if _, ok := SERVICE_TYPES[strings.ToLower(*service)]; !ok {
+	loaded, err := load()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		flag.Usage()
 		os.Exit(EX_USAGE)
 	}
+	if err := setLogger(loaded.Log); err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(EX_USAGE)
+	}
+	if err := startServer(loaded, load); err != nil {
+		fatal("server stopped", err)
+	}
+}
+
+// setLogger makes a logger with the log settings of a config the default logger
+func setLogger(config surfstore.LogConfig) error {
+	logger, err := surfstore.NewLogger(os.Stderr, config.Level, config.JSON)
+	if err != nil {
+		return err
+	}
+	surfstore.SetDefaultLogger(logger)
+	return nil
+}
 
-	// Add localhost if necessary
-	addr := ""
-	if *localOnly {
-		addr += "localhost"
+// fatal logs an error that stops the server and exits
+func fatal(msg string, err error) {
+	surfstore.DefaultLogger().Error(msg, "error", err)
+	os.Exit(1)
+}
+
+// newBlockStore creates the block store's storage, encrypted if there is a key file.
+// Blocks not encrypted with the current key are re-encrypted in the background at
+// startup and whenever SIGHUP reloads the key file. The stats of blocks already in
+// the storage are loaded once the server is up, see startServer.
+func newBlockStore(blockDir string, keyFile string) (*surfstore.BlockStore, error) {
+	blockStore := surfstore.NewBlockStore()
+	if blockDir != "" {
+		storage, err := surfstore.NewDiskStorage(blockDir)
+		if err != nil {
+			return nil, err
+		}
+		blockStore.Storage = storage
+	}
+	if keyFile == "" {
+		return blockStore, nil
 	}
-	addr += ":" + strconv.Itoa(*port)
 
-	// Disable log outputs if debug flag is missing
-	if !(*debug) {
-		log.SetFlags(0)
-		log.SetOutput(ioutil.Discard)
+	keys, err := surfstore.LoadKeyRing(keyFile)
+	if err != nil {
+		return nil, err
+	}
+	storage := surfstore.NewEncryptedStorage(blockStore.Storage, keys)
+	blockStore.Storage = storage
+	rotate := func() {
+		if _, err := storage.Rotate(); err != nil {
+			surfstore.DefaultLogger().Error("re-encrypting blocks failed", "error", err)
+		}
 	}
+	go rotate()
 
-	log.Fatal(startServer(addr, strings.ToLower(*service), blockStoreAddr))
+	// SIGHUP also reloads the config, so blocks are only re-encrypted when the
+	// key file has a new current key
+	current := keys.Current
+	reload := make(chan os.Signal, 1)
+	signal.Notify(reload, syscall.SIGHUP)
+	go func() {
+		for range reload {
+			keys, err := surfstore.LoadKeyRing(keyFile)
+			if err != nil {
+				surfstore.DefaultLogger().Error("reloading block key file failed", "path", keyFile, "error", err)
+				continue
+			}
+			storage.SetKeys(keys)
+			if keys.Current != current {
+				current = keys.Current
+				rotate()
+			}
+		}
+	}()
+	return blockStore, nil
 }
 
-func startServer(hostAddr string, serviceType string, blockStoreAddr string) error {
+// startServer serves until SIGTERM or SIGINT. The health service reports each
+// service as serving once it is ready; the BlockStore is ready after the blocks
+// already in its storage were counted. On SIGHUP the config is loaded again and
+// the settings that can change while running are applied.
+func startServer(config *surfstore.ServerConfig, reload func() (*surfstore.ServerConfig, error)) error {
+	hostAddr := ":" + strconv.Itoa(config.Port)
+	if config.LocalOnly {
+		hostAddr = "localhost" + hostAddr
+	}
+	var users *surfstore.UserStore
+	if config.UsersFile != "" {
+		var err error
+		users, err = surfstore.LoadUserStore(config.UsersFile)
+		if err != nil {
+			return fmt.Errorf("cannot load users file: %w", err)
+		}
+	}
+	blockStore, err := newBlockStore(config.BlockStorage.Dir, config.BlockStorage.KeyFile)
+	if err != nil {
+		return fmt.Errorf("cannot set up block storage: %w", err)
+	}
 	//step1 : create new server
-	grpcServer := grpc.NewServer()
+	creds, err := surfstore.NewServerCredentials(&config.TLS)
+	if err != nil {
+		return err
+	}
+	blockStore.MaxBlockSize = config.Limits.MaxBlockSize
+	metaStore := surfstore.NewMetaStore(config.BlockStoreAddr)
+	metaStore.TombstoneRetention = config.TombstoneRetention
+	metaStore.Users = users
+	metaStore.Quota = config.Limits.Quota
+	if config.Service == "meta" {
+		blockStore = nil
+	} else if config.Service == "block" {
+		metaStore = nil
+	}
+	metrics := surfstore.NewMetrics(metaStore, blockStore)
+
+	// Calls over the rate limit are logged and counted like any other failed call.
+	// The limiter is always there, so a reload can turn it on.
+	limiter := surfstore.NewRateLimiter("/"+surfstore.BlockStore_ServiceDesc.ServiceName+"/", config.Limits.BlockRate, config.Limits.BlockBurst)
+	opts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(surfstore.LoggingInterceptor, metrics.UnaryInterceptor, limiter.UnaryInterceptor),
+		grpc.MaxRecvMsgSize(config.Limits.MaxMessageSize),
+	}
+	if creds != nil {
+		opts = append(opts, grpc.Creds(creds))
+	}
+	grpcServer := grpc.NewServer(opts...)
 	//step2 : register rpc services
-	if serviceType == "both" {
-		surfstore.RegisterBlockStoreServer(grpcServer, surfstore.NewBlockStore())
-		surfstore.RegisterMetaStoreServer(grpcServer, surfstore.NewMetaStore(blockStoreAddr))
-	} else if serviceType == "meta" {
-		surfstore.RegisterMetaStoreServer(grpcServer, surfstore.NewMetaStore(blockStoreAddr))
-	} else {
-		surfstore.RegisterBlockStoreServer(grpcServer, surfstore.NewBlockStore())
+	healthServer := health.NewServer()
+	healthServer.SetServingStatus("", healthpb.HealthCheckResponse_NOT_SERVING)
+	healthpb.RegisterHealthServer(grpcServer, healthServer)
+	if metaStore != nil {
+		surfstore.RegisterMetaStoreServer(grpcServer, metaStore)
+		healthServer.SetServingStatus(surfstore.MetaStore_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	}
+	if blockStore != nil {
+		surfstore.RegisterBlockStoreServer(grpcServer, blockStore)
+		healthServer.SetServingStatus(surfstore.BlockStore_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_NOT_SERVING)
+	}
+	surfstore.RegisterAdminServer(grpcServer, surfstore.NewAdmin(metaStore, blockStore, users))
+	healthServer.SetServingStatus(surfstore.Admin_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+	var metricsServer *http.Server
+	if config.MetricsAddr != "" {
+		mux := http.NewServeMux()
+		mux.Handle("/metrics", metrics)
+		metricsServer = &http.Server{Addr: config.MetricsAddr, Handler: mux}
+		go func() {
+			if err := metricsServer.ListenAndServe(); err != http.ErrServerClosed {
+				fatal("metrics server stopped", err)
+			}
+		}()
 	}
 	//step3 start listening on host adder
 	l, e := net.Listen("tcp", hostAddr)
 	if e != nil {
-		log.Fatal(e)
 		return e
 	}
-	return grpcServer.Serve(l)
+	surfstore.DefaultLogger().Info("server started", "addr", hostAddr, "service", config.Service, "tls", creds != nil, "users", users != nil)
 
+	go func() {
+		if blockStore != nil {
+			if err := blockStore.LoadStats(); err != nil {
+				fatal("cannot load block storage", err)
+			}
+			healthServer.SetServingStatus(surfstore.BlockStore_ServiceDesc.ServiceName, healthpb.HealthCheckResponse_SERVING)
+		}
+		healthServer.SetServingStatus("", healthpb.HealthCheckResponse_SERVING)
+		surfstore.DefaultLogger().Info("server ready")
+	}()
+
+	reloads := make(chan os.Signal, 1)
+	signal.Notify(reloads, syscall.SIGHUP)
+	go func() {
+		for range reloads {
+			next, err := reload()
+			if err != nil {
+				surfstore.DefaultLogger().Error("reloading config failed, keeping the current one", "error", err)
+				continue
+			}
+			if changed := config.RestartRequired(next); len(changed) > 0 {
+				surfstore.DefaultLogger().Warn("config changes need a restart", "settings", strings.Join(changed, ","))
+			}
+			if next.Log != config.Log {
+				if err := setLogger(next.Log); err != nil {
+					surfstore.DefaultLogger().Error("applying log settings failed", "error", err)
+					continue
+				}
+				config.Log = next.Log
+			}
+			if next.Limits != config.Limits {
+				// Bigger blocks would not fit the messages the gRPC server accepts
+				if next.Limits.MaxBlockSize+surfstore.BLOCK_MESSAGE_OVERHEAD > config.Limits.MaxMessageSize {
+					surfstore.DefaultLogger().Error("limits.maxBlockSize does not fit the running limits.maxMessageSize, keeping the current one",
+						"maxBlockSize", next.Limits.MaxBlockSize, "maxMessageSize", config.Limits.MaxMessageSize)
+					next.Limits.MaxBlockSize = config.Limits.MaxBlockSize
+				}
+				applyLimits(next.Limits, blockStore, metaStore, limiter)
+				// The message size stays what the gRPC server was created with
+				next.Limits.MaxMessageSize = config.Limits.MaxMessageSize
+				config.Limits = next.Limits
+			}
+			surfstore.DefaultLogger().Info("config reloaded")
+		}
+	}()
+
+	stopped := make(chan error, 1)
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGTERM, os.Interrupt)
+	go func() {
+		sig := <-stop
+		surfstore.DefaultLogger().Info("shutting down", "signal", sig, "timeout", config.ShutdownTimeout)
+		// Probes see the server going away before it stops accepting calls
+		healthServer.Shutdown()
+		timer := time.AfterFunc(config.ShutdownTimeout, func() {
+			surfstore.DefaultLogger().Warn("requests still running after the shutdown timeout, stopping anyway")
+			grpcServer.Stop()
+		})
+		grpcServer.GracefulStop()
+		timer.Stop()
+		if metricsServer != nil {
+			metricsServer.Close()
+		}
+		// Only flushed once no upload can add blocks anymore
+		if blockStore != nil {
+			if err := blockStore.Flush(); err != nil {
+				stopped <- err
+				return
+			}
+		}
+		stopped <- nil
+	}()
+
+	if err := grpcServer.Serve(l); err != nil {
+		return err
+	}
+	if err := <-stopped; err != nil {
+		return err
+	}
+	surfstore.DefaultLogger().Info("server stopped")
+	return nil
+}
+
+// applyLimits changes the limits of a running server's services, nil if it does not run them
+func applyLimits(limits surfstore.LimitsConfig, blockStore *surfstore.BlockStore, metaStore *surfstore.MetaStore, limiter *surfstore.RateLimiter) {
+	if blockStore != nil {
+		blockStore.SetMaxBlockSize(limits.MaxBlockSize)
+	}
+	if metaStore != nil {
+		metaStore.SetQuota(limits.Quota)
+	}
+	limiter.SetLimits(limits.BlockRate, limits.BlockBurst)
+}
+
+// runAdmin manages the users file and the block key file of a server.
+// A running server picks up user changes on its next call, and new keys on SIGHUP.
+func runAdmin(args []string) error {
+	adminFlags := flag.NewFlagSet("admin", flag.ContinueOnError)
+	adminFlags.Usage = func() {
+		fmt.Fprintf(adminFlags.Output(), "Usage of %s\n", ADMIN_USAGE_STRING)
+	}
+	usersFile := adminFlags.String("users", "", "Users file of the server")
+	keyFile := adminFlags.String("keyFile", "", "Block key file of the server")
+	if err := adminFlags.Parse(args); err != nil {
+		return err
+	}
+	args = adminFlags.Args()
+	if len(args) == 2 && args[0] == "newkey" && *keyFile != "" {
+		return surfstore.AddKey(*keyFile, args[1])
+	}
+	if *usersFile == "" || len(args) == 0 {
+		adminFlags.Usage()
+		return fmt.Errorf("missing users file or command")
+	}
+
+	users, err := surfstore.LoadUserStore(*usersFile)
+	if err != nil {
+		return err
+	}
+	switch {
+	case args[0] == "adduser" && (len(args) == 2 || len(args) == 3):
+		namespace := ""
+		if len(args) == 3 {
+			namespace = args[2]
+		}
+		err = users.AddUser(args[1], namespace)
+	case args[0] == "deluser" && len(args) == 2:
+		err = users.RemoveUser(args[1])
+	case args[0] == "token" && len(args) == 2:
+		var token string
+		token, err = users.IssueToken(args[1])
+		if err == nil {
+			fmt.Println(token)
+		}
+	case args[0] == "revoke" && len(args) == 2:
+		err = users.RevokeToken(args[1])
+	case args[0] == "promote" && len(args) == 2:
+		err = users.SetAdmin(args[1], true)
+	case args[0] == "demote" && len(args) == 2:
+		err = users.SetAdmin(args[1], false)
+	case args[0] == "quota" && len(args) == 3:
+		var blocks int
+		blocks, err = strconv.Atoi(args[2])
+		if err == nil {
+			err = users.SetQuota(args[1], blocks)
+		}
+	case args[0] == "share":
+		err = shareCommand(users, args[1:])
+	case args[0] == "unshare" && len(args) == 2:
+		err = users.RemoveACL(args[1])
+	case args[0] == "list" && len(args) == 1:
+		names := make([]string, 0, len(users.Users))
+		for name := range users.Users {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		for _, name := range names {
+			line := name + " " + users.Users[name].Namespace
+			if users.Admins[name] {
+				line += " admin"
+			}
+			fmt.Println(line)
+		}
+		namespaces := make([]string, 0, len(users.Quotas))
+		for namespace := range users.Quotas {
+			namespaces = append(namespaces, namespace)
+		}
+		sort.Strings(namespaces)
+		for _, namespace := range namespaces {
+			fmt.Printf("namespace %v quota %v blocks\n", namespace, users.Quotas[namespace])
+		}
+		prefixes := make([]string, 0, len(users.ACLs))
+		for prefix := range users.ACLs {
+			prefixes = append(prefixes, prefix)
+		}
+		sort.Strings(prefixes)
+		for _, prefix := range prefixes {
+			acl := users.ACLs[prefix]
+			fmt.Printf("%v/ owner %v, readers [%v], writers [%v]\n", prefix, acl.Owner, strings.Join(acl.Readers, " "), strings.Join(acl.Writers, " "))
+		}
+		return nil
+	default:
+		adminFlags.Usage()
+		return fmt.Errorf("unknown admin command %v", strings.Join(args, " "))
+	}
+	if err != nil {
+		return err
+	}
+	return users.Save()
+}
+
+// shareCommand restricts a subtree of the owner's namespace to the given readers and writers
+func shareCommand(users *surfstore.UserStore, args []string) error {
+	shareFlags := flag.NewFlagSet("share", flag.ContinueOnError)
+	readers := shareFlags.String("read", "", "Comma separated users that may read the subtree")
+	writers := shareFlags.String("write", "", "Comma separated users that may read and write the subtree")
+	if err := shareFlags.Parse(args); err != nil {
+		return err
+	}
+	if shareFlags.NArg() != 2 {
+		return fmt.Errorf("usage: share [-read users] [-write users] <owner> <prefix>")
+	}
+	return users.SetACL(&surfstore.ACL{
+		Owner:   shareFlags.Arg(0),
+		Prefix:  shareFlags.Arg(1),
+		Readers: splitUsers(*readers),
+		Writers: splitUsers(*writers),
+	})
+}
+
+func splitUsers(list string) []string {
+	users := make([]string, 0)
+	for _, name := range strings.Split(list, ",") {
+		if name != "" {
+			users = append(users, name)
+		}
+	}
+	return users
 }
@@ -0,0 +1,282 @@
+package main
+
+import (
+	"cse224/proj4/pkg/surfstore"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Environment variable holding the default token
+const TOKEN_ENV = "SURFSTORE_TOKEN"
+
+// Usage string
+const USAGE_STRING = "surfadmin -ca file -cert file -key file -serverName name -token token host:port stats [-servers addrs] | ls [-a] [-ns namespace] [prefix] | file [-ns namespace] [-servers addrs] <filename> | blocks [-servers addrs] <hash>..."
+
+// Exit codes
+const EX_USAGE int = 64
+const EX_NOINPUT int = 66 // no such file
+const EX_UNAVAILABLE int = 69
+const EX_SOFTWARE int = 70
+const EX_NOPERM int = 77
+
+func main() {
+	flag.Usage = func() {
+		w := flag.CommandLine.Output()
+		fmt.Fprintf(w, "Usage of %s:\n", USAGE_STRING)
+		flag.VisitAll(func(f *flag.Flag) {
+			fmt.Fprintf(w, "  -%s: %v\n", f.Name, f.Usage)
+		})
+		fmt.Fprintf(w, "  stats: what the server holds and its uptime, or each of -servers\n")
+		fmt.Fprintf(w, "  ls: files of a namespace, under prefix if given; -a includes deleted files\n")
+		fmt.Fprintf(w, "  file: a file's entry and which servers hold each of its blocks\n")
+		fmt.Fprintf(w, "  blocks: which servers hold each block, the server itself unless -servers is given\n")
+	}
+	caFile := flag.String("ca", "", "CA file used to verify the server, enables TLS")
+	certFile := flag.String("cert", "", "Client certificate file for mutual TLS")
+	keyFile := flag.String("key", "", "Client private key file for mutual TLS")
+	serverName := flag.String("serverName", "", "Name to verify server certificates against instead of the dialed host")
+	token := flag.String("token", os.Getenv(TOKEN_ENV), "Token of an admin user, defaults to $"+TOKEN_ENV)
+	flag.Parse()
+
+	args := flag.Args()
+	if len(args) < 2 {
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	creds, err := surfstore.NewClientCredentials(&surfstore.TLSConfig{
+		CertFile:   *certFile,
+		KeyFile:    *keyFile,
+		CAFile:     *caFile,
+		ServerName: *serverName,
+	})
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "TLS setup failed: %v\n", err)
+		os.Exit(EX_USAGE)
+	}
+	client := surfstore.RPCClient{Credentials: creds, Token: *token}
+	// Only errors are logged, the output is the command's
+	logger, _ := surfstore.NewLogger(os.Stderr, surfstore.LOG_ERROR, false)
+	surfstore.SetDefaultLogger(logger)
+
+	addr := args[0]
+	switch args[1] {
+	case "stats":
+		err = statsCommand(client, addr, args[2:])
+	case "ls":
+		err = lsCommand(client, addr, args[2:])
+	case "file":
+		err = fileCommand(client, addr, args[2:])
+	case "blocks":
+		err = blocksCommand(client, addr, args[2:])
+	default:
+		flag.Usage()
+		os.Exit(EX_USAGE)
+	}
+	if err != nil {
+		fmt.Fprintln(os.Stderr, status.Convert(err).Message())
+		os.Exit(exitCode(err))
+	}
+}
+
+// exitCode maps a failed call to an exit code
+func exitCode(err error) int {
+	if _, ok := err.(usageError); ok {
+		return EX_USAGE
+	}
+	switch status.Code(err) {
+	case codes.Unauthenticated, codes.PermissionDenied:
+		return EX_NOPERM
+	case codes.Unavailable, codes.DeadlineExceeded:
+		return EX_UNAVAILABLE
+	case codes.NotFound:
+		return EX_NOINPUT
+	}
+	return EX_SOFTWARE
+}
+
+type usageError string
+
+func (e usageError) Error() string {
+	return "usage: surfadmin host:port " + string(e)
+}
+
+func statsCommand(client surfstore.RPCClient, addr string, args []string) error {
+	statsFlags := flag.NewFlagSet("stats", flag.ContinueOnError)
+	servers := statsFlags.String("servers", "", "Comma separated servers to show instead of the server itself")
+	if err := statsFlags.Parse(args); err != nil || statsFlags.NArg() != 0 {
+		return usageError("stats [-servers addrs]")
+	}
+	addrs := []string{addr}
+	if *servers != "" {
+		addrs = splitAddrs(*servers)
+	}
+	for i, addr := range addrs {
+		if i > 0 {
+			fmt.Println()
+		}
+		if err := printStats(client, addr); err != nil {
+			return status.Errorf(status.Code(err), "%v: %v", addr, status.Convert(err).Message())
+		}
+	}
+	return nil
+}
+
+// printStats prints what a server holds, and for a block store how well its blocks compress
+func printStats(client surfstore.RPCClient, addr string) error {
+	var stats surfstore.ServerStats
+	if err := client.GetServerStats(addr, &stats); err != nil {
+		return err
+	}
+	fmt.Printf("server: %v\n", addr)
+	fmt.Printf("service: %v\n", stats.Service)
+	fmt.Printf("uptime: %v\n", time.Duration(stats.UptimeSeconds)*time.Second)
+	if stats.Service != "block" {
+		fmt.Printf("files: %v\n", stats.Files)
+		fmt.Printf("tombstones: %v\n", stats.Tombstones)
+		fmt.Printf("namespaces: %v\n", stats.Namespaces)
+		fmt.Printf("version conflicts: %v\n", stats.Conflicts)
+	}
+	if stats.Service != "meta" {
+		ratio := 1.0
+		if stats.StoredBytes > 0 {
+			ratio = float64(stats.RawBytes) / float64(stats.StoredBytes)
+		}
+		fmt.Printf("blocks: %v (%v compressed)\n", stats.Blocks, stats.CompressedBlocks)
+		fmt.Printf("block bytes: %v (%v stored, ratio %.2f)\n", stats.RawBytes, stats.StoredBytes, ratio)
+	}
+	return nil
+}
+
+func lsCommand(client surfstore.RPCClient, addr string, args []string) error {
+	lsFlags := flag.NewFlagSet("ls", flag.ContinueOnError)
+	all := lsFlags.Bool("a", false, "Include deleted files")
+	namespace := lsFlags.String("ns", "", "Namespace to list, the caller's own if not given")
+	if err := lsFlags.Parse(args); err != nil || lsFlags.NArg() > 1 {
+		return usageError("ls [-a] [-ns namespace] [prefix]")
+	}
+	var files []*surfstore.FileMetaData
+	if err := client.ListFiles(addr, *namespace, lsFlags.Arg(0), *all, &files); err != nil {
+		return err
+	}
+	for _, file := range files {
+		fmt.Printf("%v\tv%v\t%v\t%v blocks\t%v\n", describeState(file), file.Version, file.Size, len(blocksOf(file)), file.Filename)
+	}
+	return nil
+}
+
+func fileCommand(client surfstore.RPCClient, addr string, args []string) error {
+	fileFlags := flag.NewFlagSet("file", flag.ContinueOnError)
+	namespace := fileFlags.String("ns", "", "Namespace of the file, the caller's own if not given")
+	servers := fileFlags.String("servers", "", "Comma separated block stores to look for the blocks on, besides the MetaStore's")
+	if err := fileFlags.Parse(args); err != nil || fileFlags.NArg() != 1 {
+		return usageError("file [-ns namespace] [-servers addrs] <filename>")
+	}
+	var location surfstore.FileLocation
+	if err := client.GetFile(addr, *namespace, fileFlags.Arg(0), &location); err != nil {
+		return err
+	}
+	file := location.File
+	fmt.Printf("filename: %v\n", file.Filename)
+	fmt.Printf("state: %v\n", describeState(file))
+	fmt.Printf("version: %v\n", file.Version)
+	fmt.Printf("size: %v\n", file.Size)
+	if file.RenamedTo != "" {
+		fmt.Printf("renamed to: %v\n", file.RenamedTo)
+	}
+	fmt.Printf("block store: %v\n", location.BlockStoreAddr)
+
+	hashes := blocksOf(file)
+	if len(hashes) == 0 {
+		return nil
+	}
+	addrs := append([]string{location.BlockStoreAddr}, splitAddrs(*servers)...)
+	holders, err := locateBlocks(client, addrs, hashes)
+	if err != nil {
+		return err
+	}
+	for i, hash := range hashes {
+		fmt.Printf("block %v %v %v\n", i, hash, describeHolders(holders[hash]))
+	}
+	return nil
+}
+
+func blocksCommand(client surfstore.RPCClient, addr string, args []string) error {
+	blocksFlags := flag.NewFlagSet("blocks", flag.ContinueOnError)
+	servers := blocksFlags.String("servers", "", "Comma separated block stores to look on instead of the server itself")
+	if err := blocksFlags.Parse(args); err != nil || blocksFlags.NArg() == 0 {
+		return usageError("blocks [-servers addrs] <hash>...")
+	}
+	addrs := []string{addr}
+	if *servers != "" {
+		addrs = splitAddrs(*servers)
+	}
+	holders, err := locateBlocks(client, addrs, blocksFlags.Args())
+	if err != nil {
+		return err
+	}
+	for _, hash := range blocksFlags.Args() {
+		fmt.Printf("%v %v\n", hash, describeHolders(holders[hash]))
+	}
+	return nil
+}
+
+// locateBlocks asks every block store which of the blocks it holds
+func locateBlocks(client surfstore.RPCClient, addrs []string, hashes []string) (map[string][]string, error) {
+	holders := make(map[string][]string)
+	seen := make(map[string]bool)
+	for _, addr := range addrs {
+		if seen[addr] {
+			continue
+		}
+		seen[addr] = true
+		var found []string
+		if err := client.FindBlocks(addr, hashes, &found); err != nil {
+			return nil, status.Errorf(status.Code(err), "%v: %v", addr, status.Convert(err).Message())
+		}
+		for _, hash := range found {
+			holders[hash] = append(holders[hash], addr)
+		}
+	}
+	return holders, nil
+}
+
+// blocksOf returns the hashes of a file's blocks; a deleted file has none
+func blocksOf(file *surfstore.FileMetaData) []string {
+	if surfstore.IsDeleted(file.BlockHashList) {
+		return nil
+	}
+	return file.BlockHashList
+}
+
+func describeState(file *surfstore.FileMetaData) string {
+	if surfstore.IsDeleted(file.BlockHashList) {
+		return "deleted"
+	}
+	if file.FileType == surfstore.FileType_SYMLINK {
+		return "symlink"
+	}
+	return "file"
+}
+
+func describeHolders(addrs []string) string {
+	if len(addrs) == 0 {
+		return "missing"
+	}
+	return strings.Join(addrs, ",")
+}
+
+func splitAddrs(list string) []string {
+	addrs := make([]string, 0)
+	for _, addr := range strings.Split(list, ",") {
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
+}
@@ -0,0 +1,204 @@
+package surfstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// BlockStorage is where a BlockStore keeps block data, by block hash
+type BlockStorage interface {
+	// Get returns the data of a block, or an error wrapping os.ErrNotExist
+	Get(hash string) ([]byte, error)
+	Put(hash string, data []byte) error
+	Has(hash string) (bool, error)
+	// Hashes lists every stored block
+	Hashes() ([]string, error)
+}
+
+// Flusher is implemented by storages whose writes may not be durable yet
+type Flusher interface {
+	// Flush makes every block stored so far durable
+	Flush() error
+}
+
+// MemoryStorage keeps blocks in memory; they are lost when the server stops
+type MemoryStorage struct {
+	blocks map[string][]byte
+	mtx    sync.RWMutex
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{blocks: map[string][]byte{}}
+}
+
+func (s *MemoryStorage) Get(hash string) ([]byte, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	data, ok := s.blocks[hash]
+	if !ok {
+		return nil, fmt.Errorf("block %v: %w", hash, os.ErrNotExist)
+	}
+	return data, nil
+}
+
+func (s *MemoryStorage) Put(hash string, data []byte) error {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.blocks[hash] = data
+	return nil
+}
+
+func (s *MemoryStorage) Has(hash string) (bool, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	_, ok := s.blocks[hash]
+	return ok, nil
+}
+
+func (s *MemoryStorage) Hashes() ([]string, error) {
+	s.mtx.RLock()
+	defer s.mtx.RUnlock()
+	hashes := make([]string, 0, len(s.blocks))
+	for hash := range s.blocks {
+		hashes = append(hashes, hash)
+	}
+	return hashes, nil
+}
+
+// DiskStorage keeps each block in its own file, Dir/<first two hash characters>/<hash>.
+// Blocks are not synced to the disk as they are written but by Flush.
+type DiskStorage struct {
+	Dir string
+	// Block files written since the last flush
+	unsynced map[string]bool
+	mtx      sync.Mutex
+}
+
+func NewDiskStorage(dir string) (*DiskStorage, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	return &DiskStorage{Dir: dir, unsynced: make(map[string]bool)}, nil
+}
+
+func (s *DiskStorage) path(hash string) (string, error) {
+	// Hashes come from clients, so they must not be able to name other paths
+	if len(hash) < 2 {
+		return "", fmt.Errorf("invalid block hash %q", hash)
+	}
+	for _, c := range hash {
+		if !(c >= '0' && c <= '9' || c >= 'a' && c <= 'f') {
+			return "", fmt.Errorf("invalid block hash %q", hash)
+		}
+	}
+	return filepath.Join(s.Dir, hash[:2], hash), nil
+}
+
+func (s *DiskStorage) Get(hash string) ([]byte, error) {
+	path, err := s.path(hash)
+	if err != nil {
+		return nil, err
+	}
+	return ioutil.ReadFile(path)
+}
+
+// Put writes the block to a temporary file first, so a crash never leaves a partial block
+func (s *DiskStorage) Put(hash string, data []byte) error {
+	path, err := s.path(hash)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0700); err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+hash)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), path); err != nil {
+		return err
+	}
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	s.unsynced[path] = true
+	return nil
+}
+
+// Flush syncs the block files written since the last flush, and their directories
+func (s *DiskStorage) Flush() error {
+	s.mtx.Lock()
+	paths := s.unsynced
+	s.unsynced = make(map[string]bool)
+	s.mtx.Unlock()
+
+	dirs := map[string]bool{s.Dir: true}
+	for path := range paths {
+		if err := syncPath(path); err != nil {
+			return err
+		}
+		dirs[filepath.Dir(path)] = true
+	}
+	for dir := range dirs {
+		if err := syncPath(dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func syncPath(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	return file.Sync()
+}
+
+func (s *DiskStorage) Has(hash string) (bool, error) {
+	path, err := s.path(hash)
+	if err != nil {
+		return false, err
+	}
+	_, err = os.Stat(path)
+	if os.IsNotExist(err) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+func (s *DiskStorage) Hashes() ([]string, error) {
+	hashes := make([]string, 0)
+	dirs, err := ioutil.ReadDir(s.Dir)
+	if err != nil {
+		return nil, err
+	}
+	for _, dir := range dirs {
+		if !dir.IsDir() {
+			continue
+		}
+		files, err := ioutil.ReadDir(filepath.Join(s.Dir, dir.Name()))
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			// Temporary files of unfinished writes start with a dot
+			if file.Mode().IsRegular() && file.Name()[0] != '.' {
+				hashes = append(hashes, file.Name())
+			}
+		}
+	}
+	return hashes, nil
+}
@@ -0,0 +1,207 @@
+package surfstore
+
+import (
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
+)
+
+// KeyRing holds the keys of a block store key file, one "<id>,<hex AES-256 key>"
+// per line. New blocks are encrypted with the current key, the last one in the
+// file; the others are kept to read blocks that have not been re-encrypted yet.
+type KeyRing struct {
+	Current string
+	keys    map[string]cipher.AEAD
+}
+
+// LoadKeyRing loads a key file
+func LoadKeyRing(path string) (*KeyRing, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	ring := &KeyRing{keys: make(map[string]cipher.AEAD)}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items := strings.Split(line, CONFIG_DELIMITER)
+		if len(items) != 2 || items[0] == "" || len(items[0]) > 255 {
+			return nil, fmt.Errorf("%v line %v: expected <id>,<hex key>", path, i+1)
+		}
+		key, err := hex.DecodeString(items[1])
+		if err != nil || len(key) != 32 {
+			return nil, fmt.Errorf("%v line %v: the key must be 64 hex characters", path, i+1)
+		}
+		if _, ok := ring.keys[items[0]]; ok {
+			return nil, fmt.Errorf("%v line %v: duplicate key id %v", path, i+1, items[0])
+		}
+		if ring.keys[items[0]], err = newGCM(key); err != nil {
+			return nil, err
+		}
+		ring.Current = items[0]
+	}
+	if ring.Current == "" {
+		return nil, fmt.Errorf("%v has no keys", path)
+	}
+	return ring, nil
+}
+
+// AddKey appends a new random key to a key file, making it the current key
+func AddKey(path string, id string) error {
+	if id == "" || len(id) > 255 || strings.ContainsAny(id, CONFIG_DELIMITER+"\n") {
+		return fmt.Errorf("invalid key id %q", id)
+	}
+	if ring, err := LoadKeyRing(path); err == nil {
+		if _, ok := ring.keys[id]; ok {
+			return fmt.Errorf("key id %v already exists", id)
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	key := make([]byte, 32)
+	if _, err := rand.Read(key); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		return err
+	}
+	if _, err := fmt.Fprintf(file, "%v%v%v\n", id, CONFIG_DELIMITER, hex.EncodeToString(key)); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// EncryptedStorage encrypts blocks with AES-GCM before they reach the storage
+// underneath. Each stored block is the key id length and key id, the nonce and
+// the ciphertext; the block hash is authenticated too, so blocks cannot be
+// swapped on disk.
+type EncryptedStorage struct {
+	Inner     BlockStorage
+	keys      *KeyRing
+	keysMtx   sync.RWMutex
+	rotateMtx sync.Mutex
+}
+
+func NewEncryptedStorage(inner BlockStorage, keys *KeyRing) *EncryptedStorage {
+	return &EncryptedStorage{Inner: inner, keys: keys}
+}
+
+// SetKeys replaces the key ring, for example after a new key was added to the key file
+func (s *EncryptedStorage) SetKeys(keys *KeyRing) {
+	s.keysMtx.Lock()
+	defer s.keysMtx.Unlock()
+	s.keys = keys
+}
+
+func (s *EncryptedStorage) keyRing() *KeyRing {
+	s.keysMtx.RLock()
+	defer s.keysMtx.RUnlock()
+	return s.keys
+}
+
+func (s *EncryptedStorage) Get(hash string) ([]byte, error) {
+	sealed, err := s.Inner.Get(hash)
+	if err != nil {
+		return nil, err
+	}
+	data, _, err := s.open(hash, sealed)
+	return data, err
+}
+
+func (s *EncryptedStorage) Put(hash string, data []byte) error {
+	sealed, err := s.seal(hash, data)
+	if err != nil {
+		return err
+	}
+	return s.Inner.Put(hash, sealed)
+}
+
+func (s *EncryptedStorage) Has(hash string) (bool, error) {
+	return s.Inner.Has(hash)
+}
+
+func (s *EncryptedStorage) Hashes() ([]string, error) {
+	return s.Inner.Hashes()
+}
+
+func (s *EncryptedStorage) Flush() error {
+	if flusher, ok := s.Inner.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (s *EncryptedStorage) seal(hash string, data []byte) ([]byte, error) {
+	keys := s.keyRing()
+	aead := keys.keys[keys.Current]
+	sealed := append([]byte{byte(len(keys.Current))}, keys.Current...)
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	sealed = append(sealed, nonce...)
+	return aead.Seal(sealed, nonce, data, []byte(hash)), nil
+}
+
+// open decrypts a stored block and returns the id of the key it was encrypted with
+func (s *EncryptedStorage) open(hash string, sealed []byte) ([]byte, string, error) {
+	if len(sealed) < 1 || len(sealed) < 1+int(sealed[0]) {
+		return nil, "", fmt.Errorf("block %v is corrupt", hash)
+	}
+	id := string(sealed[1 : 1+sealed[0]])
+	aead, ok := s.keyRing().keys[id]
+	if !ok {
+		return nil, id, fmt.Errorf("block %v is encrypted with unknown key %v", hash, id)
+	}
+	sealed = sealed[1+len(id):]
+	if len(sealed) < aead.NonceSize() {
+		return nil, id, fmt.Errorf("block %v is corrupt", hash)
+	}
+	data, err := aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], []byte(hash))
+	if err != nil {
+		return nil, id, fmt.Errorf("block %v: %w", hash, err)
+	}
+	return data, id, nil
+}
+
+// Rotate re-encrypts every block that is not encrypted with the current key.
+// It runs alongside normal requests; once it returns without error, keys other
+// than the current one can be removed from the key file.
+func (s *EncryptedStorage) Rotate() (int, error) {
+	s.rotateMtx.Lock()
+	defer s.rotateMtx.Unlock()
+
+	hashes, err := s.Inner.Hashes()
+	if err != nil {
+		return 0, err
+	}
+	rotated := 0
+	for _, hash := range hashes {
+		sealed, err := s.Inner.Get(hash)
+		if err != nil {
+			return rotated, err
+		}
+		data, id, err := s.open(hash, sealed)
+		if err != nil {
+			return rotated, err
+		}
+		if id == s.keyRing().Current {
+			continue
+		}
+		if err := s.Put(hash, data); err != nil {
+			return rotated, err
+		}
+		rotated += 1
+	}
+	DefaultLogger().Info("blocks re-encrypted", "blocks", rotated, "key", s.keyRing().Current)
+	return rotated, nil
+}
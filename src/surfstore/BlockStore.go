@@ -1,27 +1,82 @@
 package surfstore
 
 import (
+	"bytes"
+	"compress/gzip"
 	context "context"
+	"encoding/binary"
+	"errors"
 	"fmt"
+	"io/ioutil"
+	"os"
+	"sync"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	// Registers the gzip compressor, so clients can compress block transfers
+	_ "google.golang.org/grpc/encoding/gzip"
 )
 
 type BlockStore struct {
-	BlockMap map[string]*Block
+	Storage BlockStorage
+	// Largest block PutBlock accepts, in bytes. Zero accepts any size. Use
+	// SetMaxBlockSize to change it while serving.
+	MaxBlockSize int
+	stats        BlockStoreStats
+	mtx          sync.Mutex
 	UnimplementedBlockStoreServer
 }
 
 func (bs *BlockStore) GetBlock(ctx context.Context, blockHash *BlockHash) (*Block, error) {
-	val, ok := bs.BlockMap[blockHash.Hash]
+	if err := validateHash(blockHash.Hash); err != nil {
+		return nil, err
+	}
+	stored, err := bs.Storage.Get(blockHash.Hash)
 
-	if !ok {
-		return nil, fmt.Errorf("BlockHash %v is not found in the map", blockHash.Hash)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, status.Errorf(codes.NotFound, "block %v not found", blockHash.Hash)
+	} else if err != nil {
+		return nil, err
 	} else {
-		return val, nil
+		data, err := decodeStoredBlock(stored)
+		if err != nil {
+			return nil, fmt.Errorf("block %v: %w", blockHash.Hash, err)
+		}
+		return &Block{BlockData: data, BlockSize: int32(len(data))}, nil
 	}
 }
 
+// SetMaxBlockSize changes the largest block PutBlock accepts
+func (bs *BlockStore) SetMaxBlockSize(size int) {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	bs.MaxBlockSize = size
+}
+
 func (bs *BlockStore) PutBlock(ctx context.Context, block *Block) (*Success, error) {
-	bs.BlockMap[GetBlockHashString(block.BlockData)] = block
+	bs.mtx.Lock()
+	maxBlockSize := bs.MaxBlockSize
+	bs.mtx.Unlock()
+	if maxBlockSize > 0 && len(block.BlockData) > maxBlockSize {
+		return nil, invalidArgument("block of %v bytes is larger than the limit of %v bytes", len(block.BlockData), maxBlockSize)
+	}
+	hash := GetBlockHashString(block.BlockData)
+	stored := encodeStoredBlock(block.BlockData)
+
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	exists, err := bs.Storage.Has(hash)
+	if err != nil {
+		return nil, err
+	}
+	if err := bs.Storage.Put(hash, stored); err != nil {
+		return nil, err
+	}
+	if !exists {
+		bs.count(len(block.BlockData), stored)
+	}
+	LoggerFrom(ctx).Debug("block stored", "hash", hash, "bytes", len(block.BlockData), "stored_bytes", len(stored), "new", !exists)
 	return &Success{Flag: true}, nil
 }
 
@@ -30,10 +85,14 @@ func (bs *BlockStore) PutBlock(ctx context.Context, block *Block) (*Success, err
 func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error) {
 	hashes := make([]string, 0)
 	for i := 0; i < len(blockHashesIn.Hashes); i++ {
-		_, ok := bs.BlockMap[blockHashesIn.Hashes[i]]
-		if !ok {
-			return nil, fmt.Errorf("HasBlock in BlockStore.go err, at %v", blockHashesIn.Hashes[i])
-		} else {
+		if err := validateHash(blockHashesIn.Hashes[i]); err != nil {
+			return nil, err
+		}
+		ok, err := bs.Storage.Has(blockHashesIn.Hashes[i])
+		if err != nil {
+			return nil, err
+		}
+		if ok {
 			hashes = append(hashes, blockHashesIn.Hashes[i])
 		}
 	}
@@ -41,11 +100,101 @@ func (bs *BlockStore) HasBlocks(ctx context.Context, blockHashesIn *BlockHashes)
 
 }
 
+type BlockStoreStats struct {
+	Blocks int64
+	// Size of the blocks as clients see them
+	RawBytes int64
+	// Size of the blocks as stored, after compression
+	StoredBytes      int64
+	CompressedBlocks int64
+}
+
+// Stats returns how many blocks are stored and how well they compress
+func (bs *BlockStore) Stats() BlockStoreStats {
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	return bs.stats
+}
+
+// LoadStats counts the blocks already in the storage, for storages that outlive the server
+func (bs *BlockStore) LoadStats() error {
+	hashes, err := bs.Storage.Hashes()
+	if err != nil {
+		return err
+	}
+	bs.mtx.Lock()
+	defer bs.mtx.Unlock()
+	bs.stats = BlockStoreStats{}
+	for _, hash := range hashes {
+		stored, err := bs.Storage.Get(hash)
+		if err != nil {
+			return err
+		}
+		rawSize := len(stored) - 1
+		if len(stored) > 4 && stored[0] == BLOCK_GZIP {
+			// The gzip trailer ends with the uncompressed size
+			rawSize = int(binary.LittleEndian.Uint32(stored[len(stored)-4:]))
+		}
+		bs.count(rawSize, stored)
+	}
+	DefaultLogger().Info("block storage loaded", "blocks", bs.stats.Blocks, "raw_bytes", bs.stats.RawBytes, "stored_bytes", bs.stats.StoredBytes)
+	return nil
+}
+
+// Flush makes the stored blocks durable, for storages that buffer writes.
+// Blocks being stored while it runs may not be included.
+func (bs *BlockStore) Flush() error {
+	if flusher, ok := bs.Storage.(Flusher); ok {
+		return flusher.Flush()
+	}
+	return nil
+}
+
+func (bs *BlockStore) count(rawSize int, stored []byte) {
+	bs.stats.Blocks += 1
+	bs.stats.RawBytes += int64(rawSize)
+	bs.stats.StoredBytes += int64(len(stored))
+	if len(stored) > 0 && stored[0] == BLOCK_GZIP {
+		bs.stats.CompressedBlocks += 1
+	}
+}
+
+// encodeStoredBlock prefixes block data with how it is stored,
+// gzip compressed if that makes it smaller and raw otherwise
+func encodeStoredBlock(data []byte) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(BLOCK_GZIP)
+	writer := gzip.NewWriter(&buf)
+	writer.Write(data)
+	if err := writer.Close(); err == nil && buf.Len() < len(data)+1 {
+		return buf.Bytes()
+	}
+	return append([]byte{BLOCK_RAW}, data...)
+}
+
+func decodeStoredBlock(stored []byte) ([]byte, error) {
+	if len(stored) == 0 {
+		return nil, fmt.Errorf("stored block is empty")
+	}
+	switch stored[0] {
+	case BLOCK_RAW:
+		return stored[1:], nil
+	case BLOCK_GZIP:
+		reader, err := gzip.NewReader(bytes.NewReader(stored[1:]))
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.ReadAll(reader)
+	}
+	return nil, fmt.Errorf("unknown block encoding %v", stored[0])
+}
+
 // This line guarantees all method for BlockStore are implemented
 var _ BlockStoreInterface = new(BlockStore)
 
 func NewBlockStore() *BlockStore {
 	return &BlockStore{
-		BlockMap: map[string]*Block{},
+		Storage:      NewMemoryStorage(),
+		MaxBlockSize: DEFAULT_MAX_BLOCK_SIZE,
 	}
 }
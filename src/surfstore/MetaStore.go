@@ -2,53 +2,588 @@ package surfstore
 
 import (
 	context "context"
-	"fmt"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
 	emptypb "google.golang.org/protobuf/types/known/emptypb"
 )
 
 type MetaStore struct {
-	FileMetaMap    map[string]*FileMetaData
+	// File maps by namespace. Without users everything is in DEFAULT_NAMESPACE.
+	Namespaces     map[string]*Namespace
 	BlockStoreAddr string
+	// How long a tombstone is kept before it may be purged. Zero keeps tombstones forever.
+	TombstoneRetention time.Duration
+	// Users allowed to call the MetaStore, nil to accept every caller
+	Users *UserStore
+	// Distinct blocks the files of a namespace may reference, unless the
+	// users file gives the namespace its own quota. Zero is unlimited.
+	Quota int
+	// File updates rejected for an outdated version, since the server started
+	conflicts int64
+	mtx       sync.Mutex
 	UnimplementedMetaStoreServer
 }
 
+// Namespace is one isolated file map with its own sync bookkeeping
+type Namespace struct {
+	FileMetaMap map[string]*FileMetaData
+	// Last snapshot time acknowledged by each known client
+	ClientAcks map[string]int64
+	// Deletion time of the newest purged tombstone. Clients that acknowledged
+	// an older snapshot may have missed a deletion and must fully reconcile.
+	PurgeHorizon int64
+	// Number of files referencing each block, kept up to date by setFile
+	blockRefs map[string]int
+}
+
+func NewNamespace() *Namespace {
+	return &Namespace{
+		FileMetaMap: map[string]*FileMetaData{},
+		ClientAcks:  map[string]int64{},
+		blockRefs:   map[string]int{},
+	}
+}
+
+// namespace authenticates the caller and returns its namespace, creating it on
+// first use, and the calling user, which is nil when there are no users.
+// It must be called with m.mtx held.
+func (m *MetaStore) namespace(ctx context.Context) (*Namespace, *User, error) {
+	name := DEFAULT_NAMESPACE
+	var user *User
+	if m.Users != nil {
+		var err error
+		user, err = authenticate(ctx, m.Users)
+		if err != nil {
+			return nil, nil, err
+		}
+		name = user.Namespace
+	}
+	ns, ok := m.Namespaces[name]
+	if !ok {
+		ns = NewNamespace()
+		m.Namespaces[name] = ns
+	}
+	return ns, user, nil
+}
+
+// requestLogger is the logger of a request, tagged with the calling user if there are users
+func requestLogger(ctx context.Context, user *User) *Logger {
+	if user == nil {
+		return LoggerFrom(ctx)
+	}
+	return LoggerFrom(ctx).With("user", user.Name)
+}
+
+func (m *MetaStore) canRead(user *User, fileName string) bool {
+	if user == nil {
+		return true
+	}
+	canRead, _ := m.Users.Access(user, fileName)
+	return canRead
+}
+
+// checkWrite returns a PermissionDenied error if the user may not change a file
+func (m *MetaStore) checkWrite(user *User, fileName string) error {
+	if user == nil {
+		return nil
+	}
+	if _, canWrite := m.Users.Access(user, fileName); !canWrite {
+		return status.Errorf(codes.PermissionDenied, "%v may not write %v", user.Name, fileName)
+	}
+	return nil
+}
+
 func (m *MetaStore) GetFileInfoMap(ctx context.Context, _ *emptypb.Empty) (*FileInfoMap, error) {
-	fileInfoMap := &FileInfoMap{FileInfoMap: m.FileMetaMap}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ns, user, err := m.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now().UnixNano()
+	ns.purgeTombstones(now, m.TombstoneRetention)
+	// Entries are replaced rather than modified, so a shallow copy is a consistent snapshot
+	snapshot := make(map[string]*FileMetaData, len(ns.FileMetaMap))
+	for fileName, metaData := range ns.FileMetaMap {
+		if !m.canRead(user, fileName) {
+			continue
+		}
+		if metaData.RenamedTo != "" && !m.canRead(user, metaData.RenamedTo) {
+			// Moved somewhere this user cannot see, which is a plain deletion to them
+			metaData = proto.Clone(metaData).(*FileMetaData)
+			metaData.RenamedTo = ""
+		}
+		snapshot[fileName] = metaData
+	}
+	fileInfoMap := &FileInfoMap{
+		FileInfoMap:  snapshot,
+		SnapshotTime: now,
+		PurgeHorizon: ns.PurgeHorizon,
+	}
 	return fileInfoMap, nil
 }
 
 func (m *MetaStore) UpdateFile(ctx context.Context, fileMetaData *FileMetaData) (*Version, error) {
-	fmt.Println("update file")
-	// fmt.Println("input version : ", fileMetaData.Version)
-	// fmt.Println("in-server version : ", m.FileMetaMap[fileMetaData.Filename].Version)
-	prevItem, inUse := m.FileMetaMap[fileMetaData.Filename]
-	if !inUse {
-		fmt.Println("it is not in used saved to map")
-		m.FileMetaMap[fileMetaData.Filename] = fileMetaData
-	} else {
-		if fileMetaData.Version == prevItem.Version+1 {
-			fmt.Println("it is in used saved to map")
-			m.FileMetaMap[fileMetaData.Filename] = fileMetaData
-		} else {
-			fileMetaData.Version = -1
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ns, user, err := m.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+	if err := validateFileMeta(fileMetaData); err != nil {
+		return nil, err
+	}
+	if err := m.checkWrite(user, fileMetaData.Filename); err != nil {
+		return nil, err
+	}
+	if err := ns.checkSymlinkPaths([]*FileMetaData{fileMetaData}); err != nil {
+		return nil, err
+	}
+
+	logger := requestLogger(ctx, user).With("filename", fileMetaData.Filename)
+	if ns.acceptsVersion(fileMetaData) {
+		if err := m.checkQuota(user, ns, []*FileMetaData{fileMetaData}); err != nil {
+			logger.Info("update over quota", "error", status.Convert(err).Message())
+			return nil, err
 		}
+		ns.storeFile(fileMetaData)
+		logger.Info("file updated", "version", fileMetaData.Version, "blocks", len(fileMetaData.BlockHashList))
+	} else {
+		logger.Info("update rejected", "version", fileMetaData.Version, "stored_version", ns.FileMetaMap[fileMetaData.Filename].Version)
+		fileMetaData.Version = -1
+		m.conflicts += 1
 	}
-	fmt.Println(m.FileMetaMap[fileMetaData.Filename])
 	return &Version{Version: fileMetaData.Version}, nil
 }
 
+// CommitFiles applies several updates all-or-nothing. Each file must pass the
+// same version check as UpdateFile, otherwise nothing is stored and the
+// conflicting filenames are returned. A tombstone with RenamedTo renames the
+// file as RenameFile does, and the version the new name got is returned.
+func (m *MetaStore) CommitFiles(ctx context.Context, fileCommit *FileCommit) (*CommitResult, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ns, user, err := m.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	seen := make(map[string]bool)
+	conflicts := make([]string, 0)
+	moved := make([]*FileMetaData, 0)
+	for _, fileMetaData := range fileCommit.Files {
+		if err := validateFileMeta(fileMetaData); err != nil {
+			return nil, err
+		}
+		if seen[fileMetaData.Filename] {
+			return nil, invalidArgument("CommitFiles got %v more than once", fileMetaData.Filename)
+		}
+		if err := m.checkWrite(user, fileMetaData.Filename); err != nil {
+			return nil, err
+		}
+		seen[fileMetaData.Filename] = true
+		if fileMetaData.RenamedTo != "" && IsDeleted(fileMetaData.BlockHashList) {
+			if err := m.checkWrite(user, fileMetaData.RenamedTo); err != nil {
+				return nil, err
+			}
+			if entry := ns.renamedEntry(fileMetaData.Filename, fileMetaData.RenamedTo, fileMetaData.Version-1); entry != nil {
+				moved = append(moved, entry)
+				continue
+			}
+			conflicts = append(conflicts, fileMetaData.Filename)
+			m.conflicts += 1
+		} else if !ns.acceptsVersion(fileMetaData) {
+			conflicts = append(conflicts, fileMetaData.Filename)
+			m.conflicts += 1
+		}
+	}
+	for _, entry := range moved {
+		if seen[entry.Filename] {
+			return nil, invalidArgument("CommitFiles got %v more than once", entry.Filename)
+		}
+		seen[entry.Filename] = true
+	}
+	files := append(append([]*FileMetaData{}, fileCommit.Files...), moved...)
+	if err := ns.checkSymlinkPaths(files); err != nil {
+		return nil, err
+	}
+	if len(conflicts) > 0 {
+		requestLogger(ctx, user).Info("commit rejected", "conflicts", conflicts)
+		return &CommitResult{Committed: false, Conflicts: conflicts}, nil
+	}
+	if err := m.checkQuota(user, ns, files); err != nil {
+		requestLogger(ctx, user).Info("commit over quota", "error", status.Convert(err).Message())
+		return nil, err
+	}
+
+	for _, fileMetaData := range fileCommit.Files {
+		ns.storeFile(fileMetaData)
+	}
+	renamedVersions := make(map[string]int32)
+	for _, entry := range moved {
+		ns.setFile(entry)
+		renamedVersions[entry.Filename] = entry.Version
+	}
+	requestLogger(ctx, user).Info("files committed", "files", len(fileCommit.Files), "renamed", len(moved))
+	return &CommitResult{Committed: true, Conflicts: conflicts, RenamedVersions: renamedVersions}, nil
+}
+
+// acceptsVersion reports whether an update may replace the stored entry.
+// A new file takes any version, an existing file only its next version.
+func (ns *Namespace) acceptsVersion(fileMetaData *FileMetaData) bool {
+	prevItem, inUse := ns.FileMetaMap[fileMetaData.Filename]
+	return !inUse || fileMetaData.Version == prevItem.Version+1
+}
+
+// checkSymlinkPaths returns an InvalidArgument error if storing the entries
+// would put a file below a symlink, or a symlink above files. Clients would
+// write such a file through the link, possibly out of their base directory.
+func (ns *Namespace) checkSymlinkPaths(files []*FileMetaData) error {
+	batch := make(map[string]*FileMetaData, len(files))
+	for _, fileMetaData := range files {
+		batch[fileMetaData.Filename] = fileMetaData
+	}
+	isLive := func(fileName string) (*FileMetaData, bool) {
+		entry, ok := batch[fileName]
+		if !ok {
+			entry, ok = ns.FileMetaMap[fileName]
+		}
+		return entry, ok && !IsDeleted(entry.BlockHashList)
+	}
+
+	for _, fileMetaData := range files {
+		if IsDeleted(fileMetaData.BlockHashList) {
+			continue
+		}
+		for dir := path.Dir(fileMetaData.Filename); dir != "."; dir = path.Dir(dir) {
+			if parent, ok := isLive(dir); ok && parent.FileType == FileType_SYMLINK {
+				return invalidArgument("%v: %v is a symbolic link", fileMetaData.Filename, dir)
+			}
+		}
+		if fileMetaData.FileType != FileType_SYMLINK {
+			continue
+		}
+		prefix := fileMetaData.Filename + "/"
+		for _, names := range []map[string]*FileMetaData{batch, ns.FileMetaMap} {
+			for fileName := range names {
+				if _, ok := isLive(fileName); ok && strings.HasPrefix(fileName, prefix) {
+					return invalidArgument("%v: symbolic link over %v", fileMetaData.Filename, fileName)
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func (ns *Namespace) storeFile(fileMetaData *FileMetaData) {
+	if IsDeleted(fileMetaData.BlockHashList) {
+		fileMetaData.DeletedAt = time.Now().UnixNano()
+	} else {
+		fileMetaData.DeletedAt = 0
+	}
+	ns.setFile(fileMetaData)
+}
+
+// setFile replaces a file's entry and moves its block references to the new one
+func (ns *Namespace) setFile(fileMetaData *FileMetaData) {
+	if prevItem, ok := ns.FileMetaMap[fileMetaData.Filename]; ok {
+		for hash := range fileBlocks(prevItem) {
+			ns.blockRefs[hash] -= 1
+			if ns.blockRefs[hash] == 0 {
+				delete(ns.blockRefs, hash)
+			}
+		}
+	}
+	for hash := range fileBlocks(fileMetaData) {
+		ns.blockRefs[hash] += 1
+	}
+	ns.FileMetaMap[fileMetaData.Filename] = fileMetaData
+}
+
+// fileBlocks returns the distinct blocks of a file entry. Tombstones and the
+// encryption key record reference none.
+func fileBlocks(fileMetaData *FileMetaData) map[string]bool {
+	blocks := make(map[string]bool)
+	if IsDeleted(fileMetaData.BlockHashList) || fileMetaData.Filename == ENCRYPTION_KEY_FILENAME {
+		return blocks
+	}
+	for _, hash := range fileMetaData.BlockHashList {
+		blocks[hash] = true
+	}
+	return blocks
+}
+
+// blocksAfter returns how many distinct blocks the namespace would reference
+// with the given entries stored
+func (ns *Namespace) blocksAfter(files []*FileMetaData) int {
+	delta := make(map[string]int)
+	for _, fileMetaData := range files {
+		if prevItem, ok := ns.FileMetaMap[fileMetaData.Filename]; ok {
+			for hash := range fileBlocks(prevItem) {
+				delta[hash] -= 1
+			}
+		}
+		for hash := range fileBlocks(fileMetaData) {
+			delta[hash] += 1
+		}
+	}
+	blocks := len(ns.blockRefs)
+	for hash, change := range delta {
+		referenced, stillReferenced := ns.blockRefs[hash] > 0, ns.blockRefs[hash]+change > 0
+		if referenced && !stillReferenced {
+			blocks -= 1
+		} else if !referenced && stillReferenced {
+			blocks += 1
+		}
+	}
+	return blocks
+}
+
+// SetQuota changes the quota of the namespaces that have none of their own
+func (m *MetaStore) SetQuota(blocks int) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.Quota = blocks
+}
+
+// checkQuota returns a ResourceExhausted error if storing the entries would
+// make the namespace reference more blocks than its quota allows, whichever
+// user writes. Changes that add no blocks always pass, so a namespace over a
+// lowered quota can still shrink.
+func (m *MetaStore) checkQuota(user *User, ns *Namespace, files []*FileMetaData) error {
+	quota := m.Quota
+	if user != nil {
+		if namespaceQuota, ok := m.Users.Quota(user.Namespace); ok {
+			quota = namespaceQuota
+		}
+	}
+	if quota <= 0 {
+		return nil
+	}
+	if blocks := ns.blocksAfter(files); blocks > quota && blocks > len(ns.blockRefs) {
+		return status.Errorf(codes.ResourceExhausted, "quota of %v blocks exceeded, the files would need %v", quota, blocks)
+	}
+	return nil
+}
+
 func (m *MetaStore) GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error) {
+	if m.Users != nil {
+		if _, err := authenticate(ctx, m.Users); err != nil {
+			return nil, err
+		}
+	}
 	blockStoreAddress := &BlockStoreAddr{Addr: m.BlockStoreAddr}
 	return blockStoreAddress, nil
 }
 
+// AckSync records that a client has applied every change up to the given snapshot
+func (m *MetaStore) AckSync(ctx context.Context, syncAck *SyncAck) (*Success, error) {
+	if syncAck.ClientId == "" {
+		return nil, invalidArgument("AckSync requires a client id")
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ns, _, err := m.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if syncAck.SnapshotTime > ns.ClientAcks[syncAck.ClientId] {
+		ns.ClientAcks[syncAck.ClientId] = syncAck.SnapshotTime
+	}
+	ns.purgeTombstones(time.Now().UnixNano(), m.TombstoneRetention)
+	return &Success{Flag: true}, nil
+}
+
+// RenameFile atomically moves a file's entry to a new name, continuing its version
+// lineage. The old name becomes a tombstone pointing at the new one so other
+// clients can rename their copy instead of deleting and downloading it again.
+func (m *MetaStore) RenameFile(ctx context.Context, renameRequest *RenameRequest) (*Version, error) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	ns, user, err := m.namespace(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	oldName, newName := renameRequest.OldFilename, renameRequest.NewFilename
+	if err := validateFilename(oldName); err != nil {
+		return nil, err
+	}
+	if err := validateFilename(newName); err != nil {
+		return nil, err
+	}
+	if renameRequest.Version < 1 {
+		return nil, invalidArgument("%v: version %v is not positive", oldName, renameRequest.Version)
+	}
+	if err := m.checkWrite(user, oldName); err != nil {
+		return nil, err
+	}
+	if err := m.checkWrite(user, newName); err != nil {
+		return nil, err
+	}
+	moved := ns.renamedEntry(oldName, newName, renameRequest.Version)
+	if moved == nil {
+		return &Version{Version: -1}, nil
+	}
+	tombstone := &FileMetaData{
+		Filename:      oldName,
+		Version:       renameRequest.Version + 1,
+		BlockHashList: []string{"0"},
+		DeletedAt:     time.Now().UnixNano(),
+		RenamedTo:     newName,
+	}
+	if err := ns.checkSymlinkPaths([]*FileMetaData{moved, tombstone}); err != nil {
+		return nil, err
+	}
+	ns.setFile(moved)
+	ns.setFile(tombstone)
+	requestLogger(ctx, user).Info("file renamed", "filename", oldName, "new_filename", newName, "version", moved.Version)
+	return &Version{Version: moved.Version}, nil
+}
+
+// renamedEntry returns the entry a file at version gets when it is renamed,
+// or nil if the stored file is at another version or the new name is taken.
+// The entry keeps the file's size, mtime, mode and type, and its version
+// follows both the old version and any tombstone already at the new name.
+func (ns *Namespace) renamedEntry(oldName string, newName string, version int32) *FileMetaData {
+	prevItem, inUse := ns.FileMetaMap[oldName]
+	if oldName == newName || !inUse || IsDeleted(prevItem.BlockHashList) || prevItem.Version != version {
+		return nil
+	}
+	newVersion := prevItem.Version + 1
+	if target, ok := ns.FileMetaMap[newName]; ok {
+		if !IsDeleted(target.BlockHashList) {
+			return nil
+		}
+		if target.Version >= newVersion {
+			newVersion = target.Version + 1
+		}
+	}
+	moved := proto.Clone(prevItem).(*FileMetaData)
+	moved.Filename = newName
+	moved.Version = newVersion
+	return moved
+}
+
+// purgeTombstones removes tombstones older than the retention that every known
+// client has acknowledged. Clients silent for longer than the retention are
+// forgotten so they cannot hold tombstones forever.
+func (ns *Namespace) purgeTombstones(now int64, retention time.Duration) {
+	if retention <= 0 {
+		return
+	}
+	cutoff := now - retention.Nanoseconds()
+	for clientId, ackedAt := range ns.ClientAcks {
+		if ackedAt < cutoff {
+			delete(ns.ClientAcks, clientId)
+		}
+	}
+
+	for fileName, metaData := range ns.FileMetaMap {
+		if !IsDeleted(metaData.BlockHashList) || metaData.DeletedAt > cutoff {
+			continue
+		}
+		acked := true
+		for _, ackedAt := range ns.ClientAcks {
+			if ackedAt < metaData.DeletedAt {
+				acked = false
+				break
+			}
+		}
+		if !acked {
+			continue
+		}
+		delete(ns.FileMetaMap, fileName)
+		if metaData.DeletedAt > ns.PurgeHorizon {
+			ns.PurgeHorizon = metaData.DeletedAt
+		}
+	}
+}
+
+// MetaStoreStats is a summary of a MetaStore's state
+type MetaStoreStats struct {
+	Files      int64
+	Tombstones int64
+	Namespaces int64
+	Conflicts  int64
+}
+
+// Stats counts the files and tombstones of every namespace
+func (m *MetaStore) Stats() MetaStoreStats {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	stats := MetaStoreStats{Namespaces: int64(len(m.Namespaces)), Conflicts: m.conflicts}
+	for _, ns := range m.Namespaces {
+		for _, metaData := range ns.FileMetaMap {
+			if IsDeleted(metaData.BlockHashList) {
+				stats.Tombstones += 1
+			} else {
+				stats.Files += 1
+			}
+		}
+	}
+	return stats
+}
+
+// ListFiles returns copies of a namespace's entries at or under a directory,
+// every entry for an empty prefix, sorted by filename
+func (m *MetaStore) ListFiles(namespace string, prefix string, includeDeleted bool) []*FileMetaData {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	files := make([]*FileMetaData, 0)
+	ns, ok := m.Namespaces[namespace]
+	if !ok {
+		return files
+	}
+	prefix = strings.Trim(prefix, "/")
+	for fileName, metaData := range ns.FileMetaMap {
+		if prefix != "" && fileName != prefix && !strings.HasPrefix(fileName, prefix+"/") {
+			continue
+		}
+		if !includeDeleted && IsDeleted(metaData.BlockHashList) {
+			continue
+		}
+		files = append(files, proto.Clone(metaData).(*FileMetaData))
+	}
+	sort.Slice(files, func(i, j int) bool {
+		return files[i].Filename < files[j].Filename
+	})
+	return files
+}
+
+// FileEntry returns a copy of a file's entry in a namespace
+func (m *MetaStore) FileEntry(namespace string, fileName string) (*FileMetaData, bool) {
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+
+	ns, ok := m.Namespaces[namespace]
+	if !ok {
+		return nil, false
+	}
+	metaData, ok := ns.FileMetaMap[fileName]
+	if !ok {
+		return nil, false
+	}
+	return proto.Clone(metaData).(*FileMetaData), true
+}
+
 // This line guarantees all method for MetaStore are implemented
 var _ MetaStoreInterface = new(MetaStore)
 
 func NewMetaStore(blockStoreAddr string) *MetaStore {
 	return &MetaStore{
-		FileMetaMap:    map[string]*FileMetaData{},
+		Namespaces:     map[string]*Namespace{},
 		BlockStoreAddr: blockStoreAddr,
 	}
 }
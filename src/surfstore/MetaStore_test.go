@@ -0,0 +1,258 @@
+package surfstore
+
+import (
+	"context"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+func TestRenameFileKeepsAttributes(t *testing.T) {
+	ctx := context.Background()
+	m := NewMetaStore("localhost:8081")
+	link := &FileMetaData{
+		Filename:      "link",
+		Version:       1,
+		BlockHashList: []string{GetBlockHashString([]byte("a.txt"))},
+		Size:          5,
+		Mtime:         1700000000000000000,
+		Mode:          0777,
+		FileType:      FileType_SYMLINK,
+	}
+	if version, err := m.UpdateFile(ctx, link); err != nil || version.Version != 1 {
+		t.Fatalf("UpdateFile = %v, %v", version, err)
+	}
+	version, err := m.RenameFile(ctx, &RenameRequest{OldFilename: "link", NewFilename: "link2", Version: 1})
+	if err != nil || version.Version != 2 {
+		t.Fatalf("RenameFile = %v, %v", version, err)
+	}
+
+	fileInfoMap, err := m.GetFileInfoMap(ctx, &emptypb.Empty{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	moved := fileInfoMap.FileInfoMap["link2"]
+	if moved == nil {
+		t.Fatal("link2 is missing")
+	}
+	if moved.FileType != FileType_SYMLINK || moved.Mode != 0777 || moved.Mtime != link.Mtime || moved.Size != 5 {
+		t.Errorf("link2 = type %v mode %o mtime %v size %v, want the attributes of link", moved.FileType, moved.Mode, moved.Mtime, moved.Size)
+	}
+	if !isSameBlock(moved.BlockHashList, link.BlockHashList) || moved.Version != 2 {
+		t.Errorf("link2 = version %v blocks %v, want version 2 and the blocks of link", moved.Version, moved.BlockHashList)
+	}
+	if old := fileInfoMap.FileInfoMap["link"]; !IsDeleted(old.BlockHashList) || old.RenamedTo != "link2" {
+		t.Errorf("link = %v, want a tombstone renamed to link2", old)
+	}
+}
+
+func TestPurgeTombstones(t *testing.T) {
+	const hour = int64(time.Hour)
+	const now = 100 * hour
+	tombstone := func(fileName string, deletedAt int64) *FileMetaData {
+		return &FileMetaData{Filename: fileName, Version: 2, BlockHashList: []string{"0"}, DeletedAt: deletedAt}
+	}
+
+	for _, test := range []struct {
+		name        string
+		files       []*FileMetaData
+		acks        map[string]int64
+		retention   time.Duration
+		wantFiles   []string
+		wantAcks    []string
+		wantHorizon int64
+	}{
+		{
+			name:      "retention disabled",
+			files:     []*FileMetaData{tombstone("a", 1*hour)},
+			retention: 0,
+			wantFiles: []string{"a"},
+		},
+		{
+			name:        "old and acknowledged",
+			files:       []*FileMetaData{tombstone("a", 90*hour), tombstone("b", 80*hour)},
+			acks:        map[string]int64{"c1": 99 * hour},
+			retention:   2 * time.Hour,
+			wantFiles:   []string{},
+			wantAcks:    []string{"c1"},
+			wantHorizon: 90 * hour,
+		},
+		{
+			name:      "within the retention",
+			files:     []*FileMetaData{tombstone("a", 99*hour)},
+			retention: 2 * time.Hour,
+			wantFiles: []string{"a"},
+		},
+		{
+			name:      "files are kept",
+			files:     []*FileMetaData{{Filename: "a", Version: 1, BlockHashList: []string{"h1"}}},
+			retention: 2 * time.Hour,
+			wantFiles: []string{"a"},
+		},
+		{
+			name:        "silent clients are forgotten",
+			files:       []*FileMetaData{tombstone("a", 90*hour)},
+			acks:        map[string]int64{"c1": 99 * hour, "c2": 50 * hour},
+			retention:   2 * time.Hour,
+			wantFiles:   []string{},
+			wantAcks:    []string{"c1"},
+			wantHorizon: 90 * hour,
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ns := NewNamespace()
+			for _, file := range test.files {
+				ns.setFile(file)
+			}
+			for clientId, ackedAt := range test.acks {
+				ns.ClientAcks[clientId] = ackedAt
+			}
+
+			ns.purgeTombstones(now, test.retention)
+			if files := sortedKeys(ns.FileMetaMap); !reflect.DeepEqual(files, test.wantFiles) {
+				t.Errorf("files = %v, want %v", files, test.wantFiles)
+			}
+			var acks []string
+			for clientId := range ns.ClientAcks {
+				acks = append(acks, clientId)
+			}
+			sort.Strings(acks)
+			if !reflect.DeepEqual(acks, test.wantAcks) {
+				t.Errorf("acknowledging clients = %v, want %v", acks, test.wantAcks)
+			}
+			if ns.PurgeHorizon != test.wantHorizon {
+				t.Errorf("PurgeHorizon = %v, want %v", ns.PurgeHorizon, test.wantHorizon)
+			}
+		})
+	}
+}
+
+func sortedKeys(fileMetaMap map[string]*FileMetaData) []string {
+	keys := make([]string, 0, len(fileMetaMap))
+	for key := range fileMetaMap {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// testQuotaNamespace has files a and b referencing the three blocks h1, h2 and h3
+func testQuotaNamespace() *Namespace {
+	ns := NewNamespace()
+	ns.setFile(testFile("a", 1, "h1", "h2"))
+	ns.setFile(testFile("b", 1, "h2", "h3"))
+	return ns
+}
+
+func TestBlocksAfter(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		files []*FileMetaData
+		want  int
+	}{
+		{"nothing", nil, 3},
+		{"new block", []*FileMetaData{testFile("c", 1, "h4")}, 4},
+		{"shared blocks", []*FileMetaData{testFile("c", 1, "h1", "h3", "h1")}, 3},
+		{"replaced block still shared", []*FileMetaData{testFile("a", 2, "h4")}, 3},
+		{"deleted", []*FileMetaData{testFile("b", 2, "0")}, 2},
+		{"moved", []*FileMetaData{testFile("a", 2, "0"), testFile("c", 1, "h1", "h2")}, 3},
+		{"encryption key record", []*FileMetaData{testFile(ENCRYPTION_KEY_FILENAME, 1, "h4")}, 3},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := testQuotaNamespace().blocksAfter(test.files); got != test.want {
+				t.Errorf("blocksAfter = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestCheckQuota(t *testing.T) {
+	users, err := LoadUserStore(ConcatPath(t.TempDir(), "users.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range [][]string{{"alice", "team"}, {"bob", "team"}, {"carol", ""}} {
+		if err := users.AddUser(user[0], user[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := users.SetQuota("team", 4); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, test := range []struct {
+		name    string
+		quota   int
+		user    string
+		files   []*FileMetaData
+		wantErr bool
+	}{
+		{"no quota", 0, "", []*FileMetaData{testFile("c", 1, "h4", "h5")}, false},
+		{"within the quota", 4, "", []*FileMetaData{testFile("c", 1, "h4")}, false},
+		{"over the quota", 3, "", []*FileMetaData{testFile("c", 1, "h4")}, true},
+		{"shrinking over a lowered quota", 1, "", []*FileMetaData{testFile("b", 2, "0")}, false},
+		{"unchanged over a lowered quota", 1, "", []*FileMetaData{testFile("c", 1, "h1")}, false},
+		{"namespace quota", 3, "alice", []*FileMetaData{testFile("c", 1, "h4")}, false},
+		{"namespace quota for every user", 3, "bob", []*FileMetaData{testFile("c", 1, "h4", "h5")}, true},
+		{"server quota without a namespace quota", 3, "carol", []*FileMetaData{testFile("c", 1, "h4")}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			m := NewMetaStore("localhost:8081")
+			m.Users = users
+			m.SetQuota(test.quota)
+			var user *User
+			if test.user != "" {
+				user = users.Users[test.user]
+			}
+
+			err := m.checkQuota(user, testQuotaNamespace(), test.files)
+			if test.wantErr && status.Code(err) != codes.ResourceExhausted {
+				t.Errorf("checkQuota = %v, want ResourceExhausted", err)
+			} else if !test.wantErr && err != nil {
+				t.Errorf("checkQuota = %v, want no error", err)
+			}
+		})
+	}
+}
+
+func TestCheckSymlinkPaths(t *testing.T) {
+	symlink := func(fileName string, hashes ...string) *FileMetaData {
+		file := testFile(fileName, 1, hashes...)
+		file.FileType = FileType_SYMLINK
+		return file
+	}
+	for _, test := range []struct {
+		name    string
+		files   []*FileMetaData
+		wantErr bool
+	}{
+		{"file beside a symlink", []*FileMetaData{testFile("e/g", 1, "h1")}, false},
+		{"file below a symlink", []*FileMetaData{testFile("d/sub/f", 1, "h1")}, true},
+		{"file below a deleted symlink", []*FileMetaData{testFile("t/f", 1, "h1")}, false},
+		{"tombstone below a symlink", []*FileMetaData{testFile("d/f", 2, "0")}, false},
+		{"symlink over files", []*FileMetaData{symlink("e", "h1")}, true},
+		{"symlink over deleted files", []*FileMetaData{symlink("gone", "h1")}, false},
+		{"symlink and a file below it", []*FileMetaData{symlink("x", "h1"), testFile("x/y", 1, "h2")}, true},
+		{"symlink replaced by a directory", []*FileMetaData{testFile("d", 2, "0"), testFile("d/f", 1, "h2")}, false},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			ns := NewNamespace()
+			ns.setFile(symlink("d", "h1"))
+			ns.setFile(testFile("t", 2, "0"))
+			ns.setFile(testFile("e/f", 1, "h2"))
+			ns.setFile(testFile("gone/f", 2, "0"))
+
+			err := ns.checkSymlinkPaths(test.files)
+			if test.wantErr && status.Code(err) != codes.InvalidArgument {
+				t.Errorf("checkSymlinkPaths = %v, want InvalidArgument", err)
+			} else if !test.wantErr && err != nil {
+				t.Errorf("checkSymlinkPaths = %v, want no error", err)
+			}
+		})
+	}
+}
@@ -1,10 +1,108 @@
 package surfstore
 
+import "time"
+
 const DEFAULT_META_FILENAME string = "index.txt"
+const DEFAULT_STATE_FILENAME string = ".surfstate"
+const DEFAULT_RULES_FILENAME string = ".surfrules"
+const DEFAULT_JOURNAL_FILENAME string = ".surfjournal"
+const PARTIAL_SUFFIX string = ".surfpart"
+
+// Server entry holding the salt of an encrypted namespace, never a real file
+const ENCRYPTION_KEY_FILENAME string = ".surfkey"
+const KDF_ITERATIONS int = 200000
 
 const FILENAME_INDEX int = 0
 const VERSION_INDEX int = 1
 const HASH_LIST_INDEX int = 2
+const DELETED_AT_INDEX int = 3
+const SIZE_INDEX int = 4
+const MTIME_INDEX int = 5
+const MODE_INDEX int = 6
+const FILE_TYPE_INDEX int = 7
+const INODE_INDEX int = 8
+
+// First byte of a stored block, how the rest of it is encoded
+const BLOCK_RAW byte = 0
+const BLOCK_GZIP byte = 1
 
 const CONFIG_DELIMITER string = ","
 const HASH_DELIMITER string = " "
+
+const STATE_CLIENT_ID string = "clientId"
+const STATE_LAST_SYNC string = "lastSync"
+
+const USERS_USER string = "user"
+const USERS_TOKEN string = "token"
+const USERS_ACL string = "acl"
+const USERS_ADMIN string = "admin"
+const USERS_QUOTA string = "quota"
+
+const AUTH_METADATA_KEY string = "authorization"
+const AUTH_SCHEME string = "Bearer "
+const DEFAULT_NAMESPACE string = ""
+
+const RULE_INCLUDE string = "include"
+const RULE_EXCLUDE string = "exclude"
+
+const ACTION_DELETE_LOCAL string = "delete-local"
+const ACTION_RENAME_REMOTE string = "rename-remote"
+const ACTION_RENAME_LOCAL string = "rename-local"
+const ACTION_DOWNLOAD string = "download"
+const ACTION_UPLOAD string = "upload"
+const ACTION_DELETE_REMOTE string = "delete-remote"
+
+const ERR_NETWORK string = "network"
+const ERR_CONFLICT string = "conflict"
+const ERR_LOCAL_IO string = "local-io"
+const ERR_AUTH string = "auth"
+const ERR_PERMISSION string = "permission"
+const ERR_INVALID string = "invalid"
+const ERR_LIMIT string = "limit"
+
+const OUTCOME_OK string = "ok"
+const OUTCOME_CONFLICT string = "conflict"
+const OUTCOME_FAILED string = "failed"
+const OUTCOME_DENIED string = "denied"
+
+const PROGRESS_SCAN string = "scan"
+const PROGRESS_TRANSFER string = "transfer"
+const PROGRESS_DONE string = "done"
+
+const LOG_DEBUG string = "debug"
+const LOG_INFO string = "info"
+const LOG_WARN string = "warn"
+const LOG_ERROR string = "error"
+
+const REQUEST_ID_METADATA_KEY string = "x-request-id"
+
+// Longest filename the MetaStore accepts, and longest single path element.
+// Encrypted names are about a third longer than the local ones.
+const MAX_FILENAME_LENGTH int = 16384
+const MAX_PATH_ELEMENT_LENGTH int = 1024
+
+// Default limits of a server on the blocks and messages it receives
+const DEFAULT_MAX_BLOCK_SIZE int = 4 << 20
+const DEFAULT_MAX_MESSAGE_SIZE int = 16 << 20
+
+// BlockStore calls a client host may make at once when its rate is limited
+const DEFAULT_BLOCK_BURST int = 100
+
+// Bytes a Block message needs besides its data
+const BLOCK_MESSAGE_OVERHEAD int = 16
+
+// Largest response a client accepts, enough for big file maps and blocks
+const CLIENT_MAX_MESSAGE_SIZE int = 64 << 20
+
+// Attempts per call and retries per sync a client makes when calls fail transiently
+const DEFAULT_RETRY_ATTEMPTS int = 5
+const DEFAULT_RETRY_BUDGET int = 20
+
+// Hashes asked about in one HasBlocks call when resuming an upload
+const HAS_BLOCKS_BATCH int = 1000
+
+// Least time between two progress reports of the same phase
+const PROGRESS_INTERVAL time.Duration = 200 * time.Millisecond
+
+// Characters of a terminal progress bar between its brackets
+const PROGRESS_BAR_WIDTH int = 30
@@ -184,6 +184,9 @@ type MetaStoreClient interface {
 	GetFileInfoMap(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*FileInfoMap, error)
 	UpdateFile(ctx context.Context, in *FileMetaData, opts ...grpc.CallOption) (*Version, error)
 	GetBlockStoreAddr(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*BlockStoreAddr, error)
+	AckSync(ctx context.Context, in *SyncAck, opts ...grpc.CallOption) (*Success, error)
+	RenameFile(ctx context.Context, in *RenameRequest, opts ...grpc.CallOption) (*Version, error)
+	CommitFiles(ctx context.Context, in *FileCommit, opts ...grpc.CallOption) (*CommitResult, error)
 }
 
 type metaStoreClient struct {
@@ -221,6 +224,33 @@ func (c *metaStoreClient) GetBlockStoreAddr(ctx context.Context, in *emptypb.Emp
 	return out, nil
 }
 
+func (c *metaStoreClient) AckSync(ctx context.Context, in *SyncAck, opts ...grpc.CallOption) (*Success, error) {
+	out := new(Success)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/AckSync", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) RenameFile(ctx context.Context, in *RenameRequest, opts ...grpc.CallOption) (*Version, error) {
+	out := new(Version)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/RenameFile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *metaStoreClient) CommitFiles(ctx context.Context, in *FileCommit, opts ...grpc.CallOption) (*CommitResult, error) {
+	out := new(CommitResult)
+	err := c.cc.Invoke(ctx, "/surfstore.MetaStore/CommitFiles", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
 // MetaStoreServer is the server API for MetaStore service.
 // All implementations must embed UnimplementedMetaStoreServer
 // for forward compatibility
@@ -228,6 +258,9 @@ type MetaStoreServer interface {
 	GetFileInfoMap(context.Context, *emptypb.Empty) (*FileInfoMap, error)
 	UpdateFile(context.Context, *FileMetaData) (*Version, error)
 	GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error)
+	AckSync(context.Context, *SyncAck) (*Success, error)
+	RenameFile(context.Context, *RenameRequest) (*Version, error)
+	CommitFiles(context.Context, *FileCommit) (*CommitResult, error)
 	mustEmbedUnimplementedMetaStoreServer()
 }
 
@@ -244,6 +277,15 @@ func (UnimplementedMetaStoreServer) UpdateFile(context.Context, *FileMetaData) (
 func (UnimplementedMetaStoreServer) GetBlockStoreAddr(context.Context, *emptypb.Empty) (*BlockStoreAddr, error) {
 	return nil, status.Errorf(codes.Unimplemented, "method GetBlockStoreAddr not implemented")
 }
+func (UnimplementedMetaStoreServer) AckSync(context.Context, *SyncAck) (*Success, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method AckSync not implemented")
+}
+func (UnimplementedMetaStoreServer) RenameFile(context.Context, *RenameRequest) (*Version, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method RenameFile not implemented")
+}
+func (UnimplementedMetaStoreServer) CommitFiles(context.Context, *FileCommit) (*CommitResult, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method CommitFiles not implemented")
+}
 func (UnimplementedMetaStoreServer) mustEmbedUnimplementedMetaStoreServer() {}
 
 // UnsafeMetaStoreServer may be embedded to opt out of forward compatibility for this service.
@@ -311,6 +353,60 @@ func _MetaStore_GetBlockStoreAddr_Handler(srv interface{}, ctx context.Context,
 	return interceptor(ctx, in, info, handler)
 }
 
+func _MetaStore_AckSync_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SyncAck)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).AckSync(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/AckSync",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).AckSync(ctx, req.(*SyncAck))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_RenameFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(RenameRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).RenameFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/RenameFile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).RenameFile(ctx, req.(*RenameRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _MetaStore_CommitFiles_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileCommit)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(MetaStoreServer).CommitFiles(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.MetaStore/CommitFiles",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(MetaStoreServer).CommitFiles(ctx, req.(*FileCommit))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
 // MetaStore_ServiceDesc is the grpc.ServiceDesc for MetaStore service.
 // It's only intended for direct use with grpc.RegisterService,
 // and not to be introspected or modified (even as a copy)
@@ -330,6 +426,214 @@ var MetaStore_ServiceDesc = grpc.ServiceDesc{
 			MethodName: "GetBlockStoreAddr",
 			Handler:    _MetaStore_GetBlockStoreAddr_Handler,
 		},
+		{
+			MethodName: "AckSync",
+			Handler:    _MetaStore_AckSync_Handler,
+		},
+		{
+			MethodName: "RenameFile",
+			Handler:    _MetaStore_RenameFile_Handler,
+		},
+		{
+			MethodName: "CommitFiles",
+			Handler:    _MetaStore_CommitFiles_Handler,
+		},
+	},
+	Streams:  []grpc.StreamDesc{},
+	Metadata: "pkg/surfstore/SurfStore.proto",
+}
+
+// AdminClient is the client API for Admin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type AdminClient interface {
+	GetServerStats(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ServerStats, error)
+	ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*FileList, error)
+	GetFile(ctx context.Context, in *FileRequest, opts ...grpc.CallOption) (*FileLocation, error)
+	// Returns the subset of the hashes stored on this server
+	FindBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error)
+}
+
+type adminClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewAdminClient(cc grpc.ClientConnInterface) AdminClient {
+	return &adminClient{cc}
+}
+
+func (c *adminClient) GetServerStats(ctx context.Context, in *emptypb.Empty, opts ...grpc.CallOption) (*ServerStats, error) {
+	out := new(ServerStats)
+	err := c.cc.Invoke(ctx, "/surfstore.Admin/GetServerStats", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) ListFiles(ctx context.Context, in *ListFilesRequest, opts ...grpc.CallOption) (*FileList, error) {
+	out := new(FileList)
+	err := c.cc.Invoke(ctx, "/surfstore.Admin/ListFiles", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) GetFile(ctx context.Context, in *FileRequest, opts ...grpc.CallOption) (*FileLocation, error) {
+	out := new(FileLocation)
+	err := c.cc.Invoke(ctx, "/surfstore.Admin/GetFile", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *adminClient) FindBlocks(ctx context.Context, in *BlockHashes, opts ...grpc.CallOption) (*BlockHashes, error) {
+	out := new(BlockHashes)
+	err := c.cc.Invoke(ctx, "/surfstore.Admin/FindBlocks", in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// AdminServer is the server API for Admin service.
+// All implementations must embed UnimplementedAdminServer
+// for forward compatibility
+type AdminServer interface {
+	GetServerStats(context.Context, *emptypb.Empty) (*ServerStats, error)
+	ListFiles(context.Context, *ListFilesRequest) (*FileList, error)
+	GetFile(context.Context, *FileRequest) (*FileLocation, error)
+	// Returns the subset of the hashes stored on this server
+	FindBlocks(context.Context, *BlockHashes) (*BlockHashes, error)
+	mustEmbedUnimplementedAdminServer()
+}
+
+// UnimplementedAdminServer must be embedded to have forward compatible implementations.
+type UnimplementedAdminServer struct {
+}
+
+func (UnimplementedAdminServer) GetServerStats(context.Context, *emptypb.Empty) (*ServerStats, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetServerStats not implemented")
+}
+func (UnimplementedAdminServer) ListFiles(context.Context, *ListFilesRequest) (*FileList, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListFiles not implemented")
+}
+func (UnimplementedAdminServer) GetFile(context.Context, *FileRequest) (*FileLocation, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetFile not implemented")
+}
+func (UnimplementedAdminServer) FindBlocks(context.Context, *BlockHashes) (*BlockHashes, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method FindBlocks not implemented")
+}
+func (UnimplementedAdminServer) mustEmbedUnimplementedAdminServer() {}
+
+// UnsafeAdminServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to AdminServer will
+// result in compilation errors.
+type UnsafeAdminServer interface {
+	mustEmbedUnimplementedAdminServer()
+}
+
+func RegisterAdminServer(s grpc.ServiceRegistrar, srv AdminServer) {
+	s.RegisterService(&Admin_ServiceDesc, srv)
+}
+
+func _Admin_GetServerStats_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(emptypb.Empty)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetServerStats(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.Admin/GetServerStats",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetServerStats(ctx, req.(*emptypb.Empty))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_ListFiles_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListFilesRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).ListFiles(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.Admin/ListFiles",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).ListFiles(ctx, req.(*ListFilesRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_GetFile_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(FileRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).GetFile(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.Admin/GetFile",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).GetFile(ctx, req.(*FileRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Admin_FindBlocks_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(BlockHashes)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(AdminServer).FindBlocks(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: "/surfstore.Admin/FindBlocks",
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(AdminServer).FindBlocks(ctx, req.(*BlockHashes))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+// Admin_ServiceDesc is the grpc.ServiceDesc for Admin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Admin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "surfstore.Admin",
+	HandlerType: (*AdminServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetServerStats",
+			Handler:    _Admin_GetServerStats_Handler,
+		},
+		{
+			MethodName: "ListFiles",
+			Handler:    _Admin_ListFiles_Handler,
+		},
+		{
+			MethodName: "GetFile",
+			Handler:    _Admin_GetFile_Handler,
+		},
+		{
+			MethodName: "FindBlocks",
+			Handler:    _Admin_FindBlocks_Handler,
+		},
 	},
 	Streams:  []grpc.StreamDesc{},
 	Metadata: "pkg/surfstore/SurfStore.proto",
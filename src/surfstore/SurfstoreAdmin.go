@@ -0,0 +1,130 @@
+package surfstore
+
+import (
+	context "context"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	emptypb "google.golang.org/protobuf/types/known/emptypb"
+)
+
+// Admin lets operators inspect the MetaStore and BlockStore of a server.
+// With users only admins may call it; without users anyone who can reach the
+// server can, like the other services.
+type Admin struct {
+	// Either may be nil if the server does not run that service
+	MetaStore  *MetaStore
+	BlockStore *BlockStore
+	Users      *UserStore
+	Started    time.Time
+	UnimplementedAdminServer
+}
+
+func NewAdmin(metaStore *MetaStore, blockStore *BlockStore, users *UserStore) *Admin {
+	return &Admin{
+		MetaStore:  metaStore,
+		BlockStore: blockStore,
+		Users:      users,
+		Started:    time.Now(),
+	}
+}
+
+// authorize checks that the caller is an admin and returns the namespace a
+// request is about. No namespace is the caller's own.
+func (a *Admin) authorize(ctx context.Context, namespace string) (string, error) {
+	if a.Users == nil {
+		return namespace, nil
+	}
+	user, err := authenticate(ctx, a.Users)
+	if err != nil {
+		return "", err
+	}
+	if !a.Users.IsAdmin(user) {
+		return "", status.Errorf(codes.PermissionDenied, "%v is not an admin", user.Name)
+	}
+	if namespace == "" {
+		namespace = user.Namespace
+	}
+	return namespace, nil
+}
+
+func (a *Admin) GetServerStats(ctx context.Context, _ *emptypb.Empty) (*ServerStats, error) {
+	if _, err := a.authorize(ctx, ""); err != nil {
+		return nil, err
+	}
+	stats := &ServerStats{UptimeSeconds: int64(time.Since(a.Started).Seconds())}
+	if a.MetaStore != nil {
+		metaStats := a.MetaStore.Stats()
+		stats.Service = "meta"
+		stats.Files = metaStats.Files
+		stats.Tombstones = metaStats.Tombstones
+		stats.Namespaces = metaStats.Namespaces
+		stats.Conflicts = metaStats.Conflicts
+	}
+	if a.BlockStore != nil {
+		blockStats := a.BlockStore.Stats()
+		if stats.Service == "" {
+			stats.Service = "block"
+		} else {
+			stats.Service = "both"
+		}
+		stats.Blocks = blockStats.Blocks
+		stats.RawBytes = blockStats.RawBytes
+		stats.StoredBytes = blockStats.StoredBytes
+		stats.CompressedBlocks = blockStats.CompressedBlocks
+	}
+	return stats, nil
+}
+
+func (a *Admin) ListFiles(ctx context.Context, listFilesRequest *ListFilesRequest) (*FileList, error) {
+	namespace, err := a.authorize(ctx, listFilesRequest.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if a.MetaStore == nil {
+		return nil, status.Error(codes.Unimplemented, "this server does not run the meta service")
+	}
+	return &FileList{Files: a.MetaStore.ListFiles(namespace, listFilesRequest.Prefix, listFilesRequest.IncludeDeleted)}, nil
+}
+
+func (a *Admin) GetFile(ctx context.Context, fileRequest *FileRequest) (*FileLocation, error) {
+	namespace, err := a.authorize(ctx, fileRequest.Namespace)
+	if err != nil {
+		return nil, err
+	}
+	if a.MetaStore == nil {
+		return nil, status.Error(codes.Unimplemented, "this server does not run the meta service")
+	}
+	metaData, ok := a.MetaStore.FileEntry(namespace, fileRequest.Filename)
+	if !ok {
+		return nil, status.Errorf(codes.NotFound, "no file %v", fileRequest.Filename)
+	}
+	return &FileLocation{File: metaData, BlockStoreAddr: a.MetaStore.BlockStoreAddr}, nil
+}
+
+func (a *Admin) FindBlocks(ctx context.Context, blockHashes *BlockHashes) (*BlockHashes, error) {
+	if _, err := a.authorize(ctx, ""); err != nil {
+		return nil, err
+	}
+	if a.BlockStore == nil {
+		return nil, status.Error(codes.Unimplemented, "this server does not run the block service")
+	}
+	found := make([]string, 0)
+	for _, hash := range blockHashes.Hashes {
+		if err := validateHash(hash); err != nil {
+			return nil, err
+		}
+		ok, err := a.BlockStore.Storage.Has(hash)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			found = append(found, hash)
+		}
+	}
+	return &BlockHashes{Hashes: found}, nil
+}
+
+// This line guarantees all method for Admin are implemented
+var _ AdminInterface = new(Admin)
@@ -0,0 +1,437 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+// User is an account on the MetaStore. Users sharing a namespace see the same file map.
+type User struct {
+	Name      string
+	Namespace string
+}
+
+// ACL restricts a subtree of its owner's namespace to the owner, its writers
+// and its readers. Paths without an ACL are open to every user of the namespace.
+type ACL struct {
+	Prefix  string
+	Owner   string
+	Readers []string
+	Writers []string
+}
+
+// UserStore holds the users, their tokens and the ACLs, backed by a users file with lines
+// "user,<name>,<namespace>", "token,<sha256 of token>,<name>" and
+// "acl,<prefix>,<owner>,<readers>,<writers>" where readers and writers are
+// space separated, "admin,<name>" for users that may call the Admin service
+// and "quota,<namespace>,<blocks>" for namespaces with their own storage quota. Only
+// token hashes are stored, so the file does not grant access if it leaks. The
+// file is reloaded whenever it changes, so the admin command takes effect on a
+// running server.
+type UserStore struct {
+	Path   string
+	Users  map[string]*User
+	Tokens map[string]string
+	// ACLs by prefix
+	ACLs map[string]*ACL
+	// Names of the users that may call the Admin service
+	Admins map[string]bool
+	// Distinct blocks a namespace may reference, by namespace
+	Quotas  map[string]int
+	modTime time.Time
+	mtx     sync.Mutex
+}
+
+// LoadUserStore loads a users file. A missing file is an empty store.
+func LoadUserStore(path string) (*UserStore, error) {
+	store := &UserStore{Path: path}
+	if err := store.reload(); err != nil {
+		return nil, err
+	}
+	return store, nil
+}
+
+// reload reads the users file again. The file is parsed completely before
+// anything is replaced, so a file that fails to parse leaves the last one that
+// did in force, and it is read again on the next call.
+func (s *UserStore) reload() error {
+	users := make(map[string]*User)
+	tokens := make(map[string]string)
+	acls := make(map[string]*ACL)
+	admins := make(map[string]bool)
+	quotas := make(map[string]int)
+
+	var modTime time.Time
+	var content []byte
+	info, err := os.Stat(s.Path)
+	if err == nil {
+		modTime = info.ModTime()
+		content, err = ioutil.ReadFile(s.Path)
+	}
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items := strings.Split(line, CONFIG_DELIMITER)
+		switch {
+		case items[0] == USERS_USER && len(items) == 3:
+			users[items[1]] = &User{Name: items[1], Namespace: items[2]}
+		case items[0] == USERS_TOKEN && len(items) == 3:
+			tokens[items[1]] = items[2]
+		case items[0] == USERS_ACL && len(items) == 5:
+			acls[items[1]] = &ACL{
+				Prefix:  items[1],
+				Owner:   items[2],
+				Readers: strings.Fields(items[3]),
+				Writers: strings.Fields(items[4]),
+			}
+		case items[0] == USERS_ADMIN && len(items) == 2:
+			admins[items[1]] = true
+		case items[0] == USERS_QUOTA && len(items) == 3:
+			blocks, err := strconv.Atoi(items[2])
+			if err != nil || blocks < 1 {
+				return fmt.Errorf("%v line %v: invalid quota %v", s.Path, i+1, items[2])
+			}
+			quotas[items[1]] = blocks
+		default:
+			return fmt.Errorf("%v line %v: unknown or malformed entry %v", s.Path, i+1, items[0])
+		}
+	}
+
+	s.Users, s.Tokens, s.ACLs, s.Admins, s.Quotas = users, tokens, acls, admins, quotas
+	s.modTime = modTime
+	return nil
+}
+
+// Save writes the store back to its users file
+func (s *UserStore) Save() error {
+	names := make([]string, 0, len(s.Users))
+	for name := range s.Users {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	content := ""
+	for _, name := range names {
+		content += USERS_USER + CONFIG_DELIMITER + name + CONFIG_DELIMITER + s.Users[name].Namespace + "\n"
+	}
+	for _, name := range names {
+		if s.Admins[name] {
+			content += USERS_ADMIN + CONFIG_DELIMITER + name + "\n"
+		}
+	}
+	namespaces := make([]string, 0, len(s.Quotas))
+	for namespace := range s.Quotas {
+		namespaces = append(namespaces, namespace)
+	}
+	sort.Strings(namespaces)
+	for _, namespace := range namespaces {
+		content += USERS_QUOTA + CONFIG_DELIMITER + namespace + CONFIG_DELIMITER + strconv.Itoa(s.Quotas[namespace]) + "\n"
+	}
+	hashes := make([]string, 0, len(s.Tokens))
+	for hash := range s.Tokens {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	for _, hash := range hashes {
+		content += USERS_TOKEN + CONFIG_DELIMITER + hash + CONFIG_DELIMITER + s.Tokens[hash] + "\n"
+	}
+	prefixes := make([]string, 0, len(s.ACLs))
+	for prefix := range s.ACLs {
+		prefixes = append(prefixes, prefix)
+	}
+	sort.Strings(prefixes)
+	for _, prefix := range prefixes {
+		acl := s.ACLs[prefix]
+		content += USERS_ACL + CONFIG_DELIMITER + prefix + CONFIG_DELIMITER + acl.Owner + CONFIG_DELIMITER +
+			strings.Join(acl.Readers, HASH_DELIMITER) + CONFIG_DELIMITER + strings.Join(acl.Writers, HASH_DELIMITER) + "\n"
+	}
+	// Written to a temporary file first, so a running server never loads a
+	// partial file. It holds credentials, TempFile keeps it private to the
+	// server's user.
+	tmp, err := ioutil.TempFile(filepath.Dir(s.Path), "."+filepath.Base(s.Path))
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.WriteString(content); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := os.Rename(tmp.Name(), s.Path); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+	return nil
+}
+
+// AddUser creates a user in a namespace, which defaults to the user's name
+func (s *UserStore) AddUser(name string, namespace string) error {
+	if name == "" || strings.ContainsAny(name, CONFIG_DELIMITER+"\n") || strings.ContainsAny(namespace, CONFIG_DELIMITER+"\n") {
+		return fmt.Errorf("invalid user name or namespace")
+	}
+	if _, ok := s.Users[name]; ok {
+		return fmt.Errorf("user %v already exists", name)
+	}
+	if namespace == "" {
+		namespace = name
+	}
+	s.Users[name] = &User{Name: name, Namespace: namespace}
+	return nil
+}
+
+// RemoveUser deletes a user, every token issued to it and the ACLs it owns,
+// and the quota of its namespace if no other user is left in it
+func (s *UserStore) RemoveUser(name string) error {
+	user, ok := s.Users[name]
+	if !ok {
+		return fmt.Errorf("no user %v", name)
+	}
+	delete(s.Users, name)
+	delete(s.Admins, name)
+	if !s.hasNamespace(user.Namespace) {
+		delete(s.Quotas, user.Namespace)
+	}
+	for hash, owner := range s.Tokens {
+		if owner == name {
+			delete(s.Tokens, hash)
+		}
+	}
+	for prefix, acl := range s.ACLs {
+		if acl.Owner == name {
+			delete(s.ACLs, prefix)
+		}
+	}
+	return nil
+}
+
+// SetAdmin allows or forbids a user to call the Admin service
+func (s *UserStore) SetAdmin(name string, admin bool) error {
+	if _, ok := s.Users[name]; !ok {
+		return fmt.Errorf("no user %v", name)
+	}
+	if admin {
+		s.Admins[name] = true
+	} else {
+		delete(s.Admins, name)
+	}
+	return nil
+}
+
+// IsAdmin reports whether a user may call the Admin service
+func (s *UserStore) IsAdmin(user *User) bool {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	return s.Admins[user.Name]
+}
+
+// SetQuota limits the distinct blocks a namespace may reference, whichever of
+// its users writes to it. Zero removes the namespace's own quota, the server's
+// applies again.
+func (s *UserStore) SetQuota(namespace string, blocks int) error {
+	if !s.hasNamespace(namespace) {
+		return fmt.Errorf("no user in namespace %v", namespace)
+	}
+	if blocks < 0 {
+		return fmt.Errorf("quota must not be negative")
+	}
+	if blocks == 0 {
+		delete(s.Quotas, namespace)
+	} else {
+		s.Quotas[namespace] = blocks
+	}
+	return nil
+}
+
+// Quota returns a namespace's own quota, if it has one
+func (s *UserStore) Quota(namespace string) (int, bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+	blocks, ok := s.Quotas[namespace]
+	return blocks, ok
+}
+
+func (s *UserStore) hasNamespace(namespace string) bool {
+	for _, user := range s.Users {
+		if user.Namespace == namespace {
+			return true
+		}
+	}
+	return false
+}
+
+// SetACL restricts a subtree of the owner's namespace, replacing any ACL on the same prefix.
+// A prefix is owned by one user across all namespaces. Readers and writers must
+// be users of the owner's namespace, no other user can see its files.
+func (s *UserStore) SetACL(acl *ACL) error {
+	acl.Prefix = strings.Trim(acl.Prefix, "/")
+	if acl.Prefix == "" || strings.ContainsAny(acl.Prefix, CONFIG_DELIMITER+"\n") {
+		return fmt.Errorf("invalid prefix %v", acl.Prefix)
+	}
+	owner, ok := s.Users[acl.Owner]
+	if !ok {
+		return fmt.Errorf("no user %v", acl.Owner)
+	}
+	for _, name := range append(append([]string{}, acl.Readers...), acl.Writers...) {
+		user, ok := s.Users[name]
+		if !ok {
+			return fmt.Errorf("no user %v", name)
+		}
+		if user.Namespace != owner.Namespace {
+			return fmt.Errorf("user %v is not in namespace %v of %v", name, owner.Namespace, owner.Name)
+		}
+	}
+	s.ACLs[acl.Prefix] = acl
+	return nil
+}
+
+// RemoveACL opens a subtree to its whole namespace again
+func (s *UserStore) RemoveACL(prefix string) error {
+	prefix = strings.Trim(prefix, "/")
+	if _, ok := s.ACLs[prefix]; !ok {
+		return fmt.Errorf("no ACL on %v", prefix)
+	}
+	delete(s.ACLs, prefix)
+	return nil
+}
+
+// Access reports whether a user may read and write a file of its namespace.
+// The ACL with the longest matching prefix in the user's namespace decides;
+// the owner and writers may write, readers may only read.
+func (s *UserStore) Access(user *User, fileName string) (canRead bool, canWrite bool) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	var match *ACL
+	for prefix, acl := range s.ACLs {
+		owner, ok := s.Users[acl.Owner]
+		if !ok || owner.Namespace != user.Namespace {
+			continue
+		}
+		if fileName != prefix && !strings.HasPrefix(fileName, prefix+"/") {
+			continue
+		}
+		if match == nil || len(prefix) > len(match.Prefix) {
+			match = acl
+		}
+	}
+	if match == nil || match.Owner == user.Name || containsString(match.Writers, user.Name) {
+		return true, true
+	}
+	return containsString(match.Readers, user.Name), false
+}
+
+func containsString(list []string, item string) bool {
+	for _, value := range list {
+		if value == item {
+			return true
+		}
+	}
+	return false
+}
+
+// IssueToken creates a new token for a user. The token itself is only returned here.
+func (s *UserStore) IssueToken(name string) (string, error) {
+	if _, ok := s.Users[name]; !ok {
+		return "", fmt.Errorf("no user %v", name)
+	}
+	raw := make([]byte, 32)
+	if _, err := rand.Read(raw); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(raw)
+	s.Tokens[hashToken(token)] = name
+	return token, nil
+}
+
+// RevokeToken invalidates a token
+func (s *UserStore) RevokeToken(token string) error {
+	hash := hashToken(token)
+	if _, ok := s.Tokens[hash]; !ok {
+		return fmt.Errorf("unknown token")
+	}
+	delete(s.Tokens, hash)
+	return nil
+}
+
+// Authenticate returns the user a token belongs to, picking up changes to the users file first
+func (s *UserStore) Authenticate(token string) (*User, error) {
+	s.mtx.Lock()
+	defer s.mtx.Unlock()
+
+	info, err := os.Stat(s.Path)
+	if (err == nil && !info.ModTime().Equal(s.modTime)) || (os.IsNotExist(err) && !s.modTime.IsZero()) {
+		if err := s.reload(); err != nil {
+			// Callers must not learn about the server's files, every token fails until the file is fixed
+			DefaultLogger().Error("cannot load users file", "path", s.Path, "error", err)
+			return nil, fmt.Errorf("users file unavailable")
+		}
+	}
+
+	name, ok := s.Tokens[hashToken(token)]
+	if !ok {
+		return nil, fmt.Errorf("invalid token")
+	}
+	user, ok := s.Users[name]
+	if !ok {
+		return nil, fmt.Errorf("invalid token")
+	}
+	return user, nil
+}
+
+func hashToken(token string) string {
+	hash := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(hash[:])
+}
+
+// authenticate checks the bearer token of an incoming call
+func authenticate(ctx context.Context, users *UserStore) (*User, error) {
+	md, _ := metadata.FromIncomingContext(ctx)
+	values := md.Get(AUTH_METADATA_KEY)
+	if len(values) == 0 || !strings.HasPrefix(values[0], AUTH_SCHEME) {
+		return nil, status.Error(codes.Unauthenticated, "missing token")
+	}
+	user, err := users.Authenticate(strings.TrimPrefix(values[0], AUTH_SCHEME))
+	if err != nil {
+		return nil, status.Error(codes.Unauthenticated, err.Error())
+	}
+	return user, nil
+}
+
+// tokenCredentials attaches a bearer token to every call of a client connection
+type tokenCredentials struct {
+	token string
+}
+
+func (t tokenCredentials) GetRequestMetadata(ctx context.Context, uri ...string) (map[string]string, error) {
+	return map[string]string{AUTH_METADATA_KEY: AUTH_SCHEME + t.token}, nil
+}
+
+// Tokens may be sent in plain text so servers without TLS still work; use TLS to protect them
+func (t tokenCredentials) RequireTransportSecurity() bool {
+	return false
+}
@@ -0,0 +1,111 @@
+package surfstore
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestUserStoreKeepsLastGoodFile(t *testing.T) {
+	path := ConcatPath(t.TempDir(), "users.txt")
+	admin, err := LoadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"alice", "bob"} {
+		if err := admin.AddUser(name, "team"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	token, err := admin.IssueToken("bob")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.SetACL(&ACL{Prefix: "private", Owner: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := admin.Save(); err != nil {
+		t.Fatal(err)
+	}
+
+	server, err := LoadUserStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bob, err := server.Authenticate(token)
+	if err != nil {
+		t.Fatal(err)
+	}
+	checkPrivate := func() {
+		t.Helper()
+		if canRead, canWrite := server.Access(bob, "private/x"); canRead || canWrite {
+			t.Errorf("Access(bob, private/x) = %v, %v, want no access", canRead, canWrite)
+		}
+	}
+	checkPrivate()
+
+	// A malformed line before the ACL must not leave the ACL out
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, append([]byte("user,broken\n"), content...), 0600); err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Minute)
+	if err := os.Chtimes(path, later, later); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2; i++ {
+		if _, err := server.Authenticate(token); err == nil {
+			t.Errorf("call %v with a malformed users file authenticated", i+1)
+		}
+	}
+	checkPrivate()
+
+	if err := admin.Save(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := server.Authenticate(token); err != nil {
+		t.Errorf("after fixing the users file: %v", err)
+	}
+	checkPrivate()
+}
+
+func TestSetACLNamespaces(t *testing.T) {
+	users, err := LoadUserStore(ConcatPath(t.TempDir(), "users.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, user := range [][]string{{"alice", "team"}, {"bob", "team"}, {"carol", "other"}} {
+		if err := users.AddUser(user[0], user[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for _, test := range []struct {
+		name    string
+		acl     ACL
+		wantErr bool
+	}{
+		{"same namespace", ACL{Prefix: "p1", Owner: "alice", Readers: []string{"bob"}}, false},
+		{"reader of another namespace", ACL{Prefix: "p2", Owner: "alice", Readers: []string{"carol"}}, true},
+		{"writer of another namespace", ACL{Prefix: "p3", Owner: "alice", Writers: []string{"bob", "carol"}}, true},
+		{"unknown owner", ACL{Prefix: "p4", Owner: "dave"}, true},
+		{"unknown reader", ACL{Prefix: "p5", Owner: "alice", Readers: []string{"dave"}}, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			acl := test.acl
+			err := users.SetACL(&acl)
+			if test.wantErr && err == nil {
+				t.Error("SetACL succeeded, want an error")
+			} else if !test.wantErr && err != nil {
+				t.Errorf("SetACL = %v, want no error", err)
+			}
+			if _, stored := users.ACLs[acl.Prefix]; stored == test.wantErr {
+				t.Errorf("ACL stored = %v, want %v", stored, !test.wantErr)
+			}
+		})
+	}
+}
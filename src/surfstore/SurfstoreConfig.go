@@ -0,0 +1,165 @@
+package surfstore
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// ServerConfig is everything a server is started with. It is read from a YAML
+// config file, with the keys given in the field tags, and command line flags
+// override it.
+type ServerConfig struct {
+	// meta, block or both
+	Service   string `yaml:"service"`
+	Port      int    `yaml:"port"`
+	LocalOnly bool   `yaml:"localOnly"`
+	// BlockStore the MetaStore sends clients to, this server's own address if it runs both services
+	BlockStoreAddr string    `yaml:"blockStoreAddr"`
+	Log            LogConfig `yaml:"log"`
+	TLS            TLSConfig `yaml:"tls"`
+	// Users file; without one the MetaStore does not authenticate
+	UsersFile    string             `yaml:"usersFile"`
+	BlockStorage BlockStorageConfig `yaml:"blockStorage"`
+	// Address to serve Prometheus metrics on, none if empty
+	MetricsAddr        string        `yaml:"metricsAddr"`
+	TombstoneRetention time.Duration `yaml:"tombstoneRetention"`
+	// How long a shutdown waits for requests in flight
+	ShutdownTimeout time.Duration `yaml:"shutdownTimeout"`
+	Limits          LimitsConfig  `yaml:"limits"`
+}
+
+type LogConfig struct {
+	Level string `yaml:"level"`
+	JSON  bool   `yaml:"json"`
+}
+
+type BlockStorageConfig struct {
+	// Directory to keep blocks in, in memory if empty
+	Dir string `yaml:"dir"`
+	// Key file to encrypt stored blocks with, unencrypted if empty
+	KeyFile string `yaml:"keyFile"`
+}
+
+type LimitsConfig struct {
+	// Largest block the BlockStore stores, in bytes
+	MaxBlockSize int `yaml:"maxBlockSize"`
+	// Largest request message the server receives, in bytes. It must leave
+	// room for a block of the largest size.
+	MaxMessageSize int `yaml:"maxMessageSize"`
+	// Distinct blocks the files of a namespace may reference, unless the
+	// users file gives the namespace its own quota. Zero is unlimited.
+	Quota int `yaml:"quota"`
+	// BlockStore calls each client host may make per second, unlimited if
+	// zero, and how many it may make at once
+	BlockRate  float64 `yaml:"blockRate"`
+	BlockBurst int     `yaml:"blockBurst"`
+}
+
+// Settings a running server picks up when its config is reloaded, by YAML key.
+// Of the limits, maxMessageSize is the exception: the gRPC server is created with it.
+var reloadableSettings = map[string]bool{"log": true, "limits": true}
+
+func DefaultServerConfig() *ServerConfig {
+	return &ServerConfig{
+		Port:               8080,
+		Log:                LogConfig{Level: LOG_INFO},
+		TombstoneRetention: 7 * 24 * time.Hour,
+		ShutdownTimeout:    30 * time.Second,
+		Limits: LimitsConfig{
+			MaxBlockSize:   DEFAULT_MAX_BLOCK_SIZE,
+			MaxMessageSize: DEFAULT_MAX_MESSAGE_SIZE,
+			BlockBurst:     DEFAULT_BLOCK_BURST,
+		},
+	}
+}
+
+// Load reads a config file over the values already in the config. Keys the
+// config does not have are errors, so typos do not go unnoticed.
+func (config *ServerConfig) Load(path string) error {
+	file, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	decoder := yaml.NewDecoder(file)
+	decoder.KnownFields(true)
+	if err := decoder.Decode(config); err != nil && err != io.EOF {
+		return fmt.Errorf("%v: %w", path, err)
+	}
+	return nil
+}
+
+// Validate reports every setting a server cannot start with
+func (config *ServerConfig) Validate() error {
+	problems := make([]string, 0)
+	config.Service = strings.ToLower(config.Service)
+	if config.Service != "meta" && config.Service != "block" && config.Service != "both" {
+		problems = append(problems, fmt.Sprintf("service must be meta, block or both, not %q", config.Service))
+	}
+	if config.Port < 1 || config.Port > 65535 {
+		problems = append(problems, fmt.Sprintf("port %v is out of range", config.Port))
+	}
+	if _, ok := logLevels[config.Log.Level]; !ok {
+		problems = append(problems, fmt.Sprintf("log.level must be debug, info, warn or error, not %q", config.Log.Level))
+	}
+	if (config.TLS.CertFile == "") != (config.TLS.KeyFile == "") {
+		problems = append(problems, "tls.cert and tls.key must be given together")
+	}
+	if config.TLS.RequireClientCert && config.TLS.CAFile == "" {
+		problems = append(problems, "tls.clientAuth needs tls.ca to verify client certificates")
+	}
+	if config.TLS.ServerName != "" {
+		problems = append(problems, "tls.serverName only applies to clients")
+	}
+	if config.Service == "meta" && (config.BlockStorage.Dir != "" || config.BlockStorage.KeyFile != "") {
+		problems = append(problems, "blockStorage only applies to the block service")
+	}
+	if config.TombstoneRetention < 0 {
+		problems = append(problems, "tombstoneRetention must not be negative")
+	}
+	if config.ShutdownTimeout < 0 {
+		problems = append(problems, "shutdownTimeout must not be negative")
+	}
+	if config.Limits.MaxBlockSize < 1 {
+		problems = append(problems, "limits.maxBlockSize must be positive")
+	}
+	if config.Limits.MaxMessageSize < config.Limits.MaxBlockSize+BLOCK_MESSAGE_OVERHEAD {
+		problems = append(problems, fmt.Sprintf("limits.maxMessageSize must be at least %v bytes to fit a block of limits.maxBlockSize", config.Limits.MaxBlockSize+BLOCK_MESSAGE_OVERHEAD))
+	}
+	if config.Limits.Quota < 0 {
+		problems = append(problems, "limits.quota must not be negative")
+	}
+	if config.Limits.BlockRate < 0 {
+		problems = append(problems, "limits.blockRate must not be negative")
+	}
+	if config.Limits.BlockRate > 0 && config.Limits.BlockBurst < 1 {
+		problems = append(problems, "limits.blockBurst must be positive to allow any BlockStore call")
+	}
+	if len(problems) > 0 {
+		return fmt.Errorf("invalid config: %v", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// RestartRequired lists the settings, by YAML key, that differ in another
+// config and that a running server cannot change
+func (config *ServerConfig) RestartRequired(other *ServerConfig) []string {
+	changed := make([]string, 0)
+	current, next := reflect.ValueOf(*config), reflect.ValueOf(*other)
+	for i := 0; i < current.NumField(); i++ {
+		key := current.Type().Field(i).Tag.Get("yaml")
+		if !reloadableSettings[key] && !reflect.DeepEqual(current.Field(i).Interface(), next.Field(i).Interface()) {
+			changed = append(changed, key)
+		}
+	}
+	if config.Limits.MaxMessageSize != other.Limits.MaxMessageSize {
+		changed = append(changed, "limits.maxMessageSize")
+	}
+	return changed
+}
@@ -0,0 +1,211 @@
+package surfstore
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// Cipher encrypts a client's blocks and filenames with keys derived from a
+// passphrase, so the servers only ever see ciphertext.
+//
+// Encryption is deterministic: the nonce of a block or a path component is an
+// HMAC of its plaintext. The same content therefore always gives the same
+// ciphertext, which keeps block hashes stable between syncs and lets clients
+// compare hash lists, while the hashes are keyed and the servers cannot confirm
+// a guess at the content. Block sizes and file sizes are not hidden.
+type Cipher struct {
+	blockAEAD cipher.AEAD
+	blockMAC  []byte
+	nameAEAD  cipher.AEAD
+	nameMAC   []byte
+	// Stored next to the salt so a wrong passphrase is detected before anything is decrypted
+	check []byte
+}
+
+// NewCipher derives the keys of a passphrase and salt
+func NewCipher(passphrase string, salt []byte) (*Cipher, error) {
+	master := pbkdf2SHA256([]byte(passphrase), salt, KDF_ITERATIONS, 32)
+	c := &Cipher{
+		blockMAC: deriveKey(master, "block nonce"),
+		nameMAC:  deriveKey(master, "name nonce"),
+		check:    deriveKey(master, "check"),
+	}
+	var err error
+	if c.blockAEAD, err = newGCM(deriveKey(master, "block")); err != nil {
+		return nil, err
+	}
+	if c.nameAEAD, err = newGCM(deriveKey(master, "name")); err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// NewSalt returns a random salt for a namespace that has no encryption key record yet
+func NewSalt() ([]byte, error) {
+	salt := make([]byte, 16)
+	_, err := rand.Read(salt)
+	return salt, err
+}
+
+// KeyRecord is the server entry that holds the salt and check value of a namespace's passphrase
+func (c *Cipher) KeyRecord(salt []byte) *FileMetaData {
+	return &FileMetaData{
+		Filename:      ENCRYPTION_KEY_FILENAME,
+		Version:       1,
+		BlockHashList: []string{hex.EncodeToString(salt), hex.EncodeToString(c.check)},
+	}
+}
+
+// ParseKeyRecord returns the salt and check value of a key record
+func ParseKeyRecord(record *FileMetaData) (salt []byte, check []byte, err error) {
+	if len(record.BlockHashList) != 2 {
+		return nil, nil, fmt.Errorf("malformed encryption key record")
+	}
+	if salt, err = hex.DecodeString(record.BlockHashList[0]); err != nil {
+		return nil, nil, fmt.Errorf("malformed encryption key record: %w", err)
+	}
+	if check, err = hex.DecodeString(record.BlockHashList[1]); err != nil {
+		return nil, nil, fmt.Errorf("malformed encryption key record: %w", err)
+	}
+	return salt, check, nil
+}
+
+// Matches reports whether the cipher was derived from the passphrase a check value was made with
+func (c *Cipher) Matches(check []byte) bool {
+	return hmac.Equal(c.check, check)
+}
+
+// SealBlock encrypts a block's data
+func (c *Cipher) SealBlock(data []byte) []byte {
+	return seal(c.blockAEAD, c.blockMAC, data)
+}
+
+// OpenBlock decrypts a block's data
+func (c *Cipher) OpenBlock(data []byte) ([]byte, error) {
+	return open(c.blockAEAD, data)
+}
+
+// BlockHash is the hash the block store keeps a block's data under. Without a cipher it is the plain hash.
+func (c *Cipher) BlockHash(data []byte) string {
+	if c == nil {
+		return GetBlockHashString(data)
+	}
+	return GetBlockHashString(c.SealBlock(data))
+}
+
+// EncryptName encrypts each component of a slash separated path on its own,
+// so files of the same directory still share a prefix on the server
+func (c *Cipher) EncryptName(fileName string) string {
+	parts := strings.Split(fileName, "/")
+	for i, part := range parts {
+		parts[i] = base64.RawURLEncoding.EncodeToString(seal(c.nameAEAD, c.nameMAC, []byte(part)))
+	}
+	return strings.Join(parts, "/")
+}
+
+// DecryptName reverses EncryptName
+func (c *Cipher) DecryptName(fileName string) (string, error) {
+	parts := strings.Split(fileName, "/")
+	for i, part := range parts {
+		sealed, err := base64.RawURLEncoding.DecodeString(part)
+		if err != nil {
+			return "", err
+		}
+		plain, err := open(c.nameAEAD, sealed)
+		if err != nil {
+			return "", err
+		}
+		parts[i] = string(plain)
+	}
+	return strings.Join(parts, "/"), nil
+}
+
+// EncryptMeta returns a copy of a file's metadata with encrypted names
+func (c *Cipher) EncryptMeta(metaData *FileMetaData) *FileMetaData {
+	sealed := proto.Clone(metaData).(*FileMetaData)
+	sealed.Filename = c.EncryptName(metaData.Filename)
+	if metaData.RenamedTo != "" {
+		sealed.RenamedTo = c.EncryptName(metaData.RenamedTo)
+	}
+	return sealed
+}
+
+// DecryptMeta decrypts the names of a file's metadata in place
+func (c *Cipher) DecryptMeta(metaData *FileMetaData) error {
+	fileName, err := c.DecryptName(metaData.Filename)
+	if err != nil {
+		return err
+	}
+	if metaData.RenamedTo != "" {
+		if metaData.RenamedTo, err = c.DecryptName(metaData.RenamedTo); err != nil {
+			return err
+		}
+	}
+	metaData.Filename = fileName
+	return nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// seal encrypts data with a nonce derived from the data itself, prepending the nonce
+func seal(aead cipher.AEAD, macKey []byte, data []byte) []byte {
+	mac := hmac.New(sha256.New, macKey)
+	mac.Write(data)
+	nonce := mac.Sum(nil)[:aead.NonceSize()]
+	return aead.Seal(nonce, nonce, data, nil)
+}
+
+func open(aead cipher.AEAD, sealed []byte) ([]byte, error) {
+	if len(sealed) < aead.NonceSize() {
+		return nil, fmt.Errorf("ciphertext too short")
+	}
+	nonce := sealed[:aead.NonceSize()]
+	return aead.Open(nil, nonce, sealed[aead.NonceSize():], nil)
+}
+
+func deriveKey(master []byte, label string) []byte {
+	mac := hmac.New(sha256.New, master)
+	mac.Write([]byte(label))
+	return mac.Sum(nil)
+}
+
+// pbkdf2SHA256 is PBKDF2 (RFC 8018) with HMAC-SHA256
+func pbkdf2SHA256(password []byte, salt []byte, iterations int, keyLen int) []byte {
+	prf := hmac.New(sha256.New, password)
+	key := make([]byte, 0, keyLen)
+	for block := uint32(1); len(key) < keyLen; block++ {
+		prf.Reset()
+		prf.Write(salt)
+		var counter [4]byte
+		binary.BigEndian.PutUint32(counter[:], block)
+		prf.Write(counter[:])
+		u := prf.Sum(nil)
+		t := append([]byte(nil), u...)
+		for i := 1; i < iterations; i++ {
+			prf.Reset()
+			prf.Write(u)
+			u = prf.Sum(u[:0])
+			for j := range t {
+				t[j] ^= u[j]
+			}
+		}
+		key = append(key, t...)
+	}
+	return key[:keyLen]
+}
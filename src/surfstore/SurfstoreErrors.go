@@ -0,0 +1,85 @@
+package surfstore
+
+import (
+	"errors"
+	"fmt"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// SyncError is a failure during a sync, classified by where it happened so
+// callers can tell a lost connection from a conflict or a local disk problem.
+type SyncError struct {
+	Kind     string
+	Filename string
+	Err      error
+}
+
+func (e *SyncError) Error() string {
+	if e.Filename == "" {
+		return fmt.Sprintf("%v error: %v", e.Kind, e.Err)
+	}
+	return fmt.Sprintf("%v error on %v: %v", e.Kind, e.Filename, e.Err)
+}
+
+func (e *SyncError) Unwrap() error {
+	return e.Err
+}
+
+// ErrConflict is wrapped by every conflict SyncError
+var ErrConflict = errors.New("the server has a newer version")
+
+// networkError classifies a failed call to a server. Calls the server refused
+// for lack of valid credentials are auth errors, changes the caller may not
+// make are permission errors and requests the server found malformed, like a
+// block over its size limit, are invalid errors. Calls over the caller's quota
+// or rate limit are limit errors. Only the rest are network errors.
+func networkError(fileName string, err error) error {
+	if err == nil {
+		return nil
+	}
+	switch status.Code(err) {
+	case codes.Unauthenticated:
+		return &SyncError{Kind: ERR_AUTH, Filename: fileName, Err: err}
+	case codes.PermissionDenied:
+		return &SyncError{Kind: ERR_PERMISSION, Filename: fileName, Err: errors.New(status.Convert(err).Message())}
+	case codes.InvalidArgument:
+		return &SyncError{Kind: ERR_INVALID, Filename: fileName, Err: errors.New(status.Convert(err).Message())}
+	case codes.ResourceExhausted:
+		return &SyncError{Kind: ERR_LIMIT, Filename: fileName, Err: errors.New(status.Convert(err).Message())}
+	}
+	return &SyncError{Kind: ERR_NETWORK, Filename: fileName, Err: err}
+}
+
+func localError(fileName string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &SyncError{Kind: ERR_LOCAL_IO, Filename: fileName, Err: err}
+}
+
+func conflictError(fileName string, reason string) error {
+	return &SyncError{Kind: ERR_CONFLICT, Filename: fileName, Err: fmt.Errorf("%w, %v", ErrConflict, reason)}
+}
+
+// ErrorKind returns the kind of a SyncError anywhere in err's chain, or "" if there is none
+func ErrorKind(err error) string {
+	var syncErr *SyncError
+	if errors.As(err, &syncErr) {
+		return syncErr.Kind
+	}
+	return ""
+}
+
+// Refused credentials are reported over network failures, those over local ones,
+// and all of them over exceeded limits, files the server rejects as invalid,
+// files the user may not change and conflicts
+var errorSeverity = map[string]int{ERR_CONFLICT: 1, ERR_PERMISSION: 2, ERR_INVALID: 3, ERR_LIMIT: 4, ERR_LOCAL_IO: 5, ERR_NETWORK: 6, ERR_AUTH: 7}
+
+func moreSevere(a error, b error) error {
+	if a == nil || errorSeverity[ErrorKind(b)] > errorSeverity[ErrorKind(a)] {
+		return b
+	}
+	return a
+}
@@ -2,13 +2,16 @@ package surfstore
 
 import (
 	"bufio"
+	"crypto/rand"
 	"crypto/sha256"
 	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
+	"io/ioutil"
 	"os"
+	"path"
 	"path/filepath"
+	"sort"
 	"strconv"
 	"strings"
 )
@@ -43,28 +46,61 @@ func NewFileMetaDataFromConfig(configString string) *FileMetaData {
 	version, _ := strconv.Atoi(configItems[VERSION_INDEX])
 	blockHashList := strings.Split(configItems[HASH_LIST_INDEX], HASH_DELIMITER)
 
-	return &FileMetaData{
+	fileMetaData := &FileMetaData{
 		Filename:      filename,
 		Version:       int32(version),
 		BlockHashList: blockHashList[:len(blockHashList)-1],
 	}
+
+	// Older index files stop after the hash list or the deletion time
+	if len(configItems) > DELETED_AT_INDEX {
+		fileMetaData.DeletedAt, _ = strconv.ParseInt(configItems[DELETED_AT_INDEX], 10, 64)
+	}
+	if len(configItems) > FILE_TYPE_INDEX {
+		fileMetaData.Size, _ = strconv.ParseInt(configItems[SIZE_INDEX], 10, 64)
+		fileMetaData.Mtime, _ = strconv.ParseInt(configItems[MTIME_INDEX], 10, 64)
+		mode, _ := strconv.ParseUint(configItems[MODE_INDEX], 8, 32)
+		fileMetaData.Mode = uint32(mode)
+		fileType, _ := strconv.Atoi(configItems[FILE_TYPE_INDEX])
+		fileMetaData.FileType = FileType(fileType)
+	}
+	return fileMetaData
+}
+
+// inodeFromConfig returns the inode recorded in a line of the local metadata
+// file, 0 if the line has none. Inodes only serve the client's scan cache, so
+// they are kept in the file but not in FileMetaData.
+func inodeFromConfig(configString string) uint64 {
+	configItems := strings.Split(configString, CONFIG_DELIMITER)
+	if len(configItems) <= INODE_INDEX {
+		return 0
+	}
+	inode, _ := strconv.ParseUint(configItems[INODE_INDEX], 10, 64)
+	return inode
 }
 
 // LoadMetaFromMetaFiles loads the local metadata file into a file meta map.
 // The key is the file's name and the value is the file's metadata.
 // You can use this function to load the index.txt file in this project.
 func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData, e error) {
+	fileMetaMap, _, e = loadIndexFile(baseDir)
+	return fileMetaMap, e
+}
+
+// loadIndexFile loads the local metadata file together with the inode of each file
+func loadIndexFile(baseDir string) (fileMetaMap map[string]*FileMetaData, inodes map[string]uint64, e error) {
 	metaFilePath, _ := filepath.Abs(ConcatPath(baseDir, DEFAULT_META_FILENAME))
 
 	fileMetaMap = make(map[string]*FileMetaData)
+	inodes = make(map[string]uint64)
 
 	metaFileStats, e := os.Stat(metaFilePath)
 	if e != nil || metaFileStats.IsDir() {
-		return fileMetaMap, nil
+		return fileMetaMap, inodes, nil
 	}
 	metaFD, e := os.Open(metaFilePath)
 	if e != nil {
-		log.Fatal("Error When Opening Meta")
+		return nil, nil, fmt.Errorf("error when opening meta: %w", e)
 	}
 	defer metaFD.Close()
 
@@ -73,7 +109,7 @@ func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData,
 	for {
 		lineContent, isPrefix, e := metaReader.ReadLine()
 		if e != nil && e != io.EOF {
-			log.Fatal("Error During Reading Meta")
+			return nil, nil, fmt.Errorf("error during reading meta: %w", e)
 		}
 
 		leftOverContent += string(lineContent)
@@ -86,17 +122,24 @@ func LoadMetaFromMetaFile(baseDir string) (fileMetaMap map[string]*FileMetaData,
 		}
 
 		currFileMeta := NewFileMetaDataFromConfig(leftOverContent)
+		inodes[currFileMeta.Filename] = inodeFromConfig(leftOverContent)
 
 		leftOverContent = ""
 		fileMetaMap[currFileMeta.Filename] = currFileMeta
 	}
 
-	return fileMetaMap, nil
+	return fileMetaMap, inodes, nil
 }
 
 // FileMetaDataToString converts a FileMetaData struct
 // to a string for writing back to local metadata file
 func FileMetaDataToString(fm *FileMetaData) (result string) {
+	return fileMetaDataLine(fm, 0)
+}
+
+// fileMetaDataLine converts a FileMetaData struct and the file's inode to a
+// line of the local metadata file
+func fileMetaDataLine(fm *FileMetaData, inode uint64) (result string) {
 	result += fm.Filename + ","
 	result += strconv.Itoa(int(fm.Version)) + ","
 
@@ -104,27 +147,173 @@ func FileMetaDataToString(fm *FileMetaData) (result string) {
 		result += blockHash + " "
 	}
 
+	result += "," + strconv.FormatInt(fm.DeletedAt, 10)
+	result += "," + strconv.FormatInt(fm.Size, 10)
+	result += "," + strconv.FormatInt(fm.Mtime, 10)
+	result += "," + strconv.FormatUint(uint64(fm.Mode), 8)
+	result += "," + strconv.Itoa(int(fm.FileType))
+	result += "," + strconv.FormatUint(inode, 10)
 	result += "\n"
 	return
 }
 
 // WriteMetaFile writes the file meta map back to local metadata file
 func WriteMetaFile(fileMetas map[string]*FileMetaData, baseDir string) error {
+	return writeIndexFile(fileMetas, nil, baseDir)
+}
+
+// writeIndexFile writes the file meta map and the inode of each file back to
+// the local metadata file
+func writeIndexFile(fileMetas map[string]*FileMetaData, inodes map[string]uint64, baseDir string) error {
 	outputMetaPath := ConcatPath(baseDir, DEFAULT_META_FILENAME)
 
 	outFD, err := os.Create(outputMetaPath)
 	if err != nil {
-		log.Fatal("Error During Meta Write Back")
+		return fmt.Errorf("error during meta write back: %w", err)
 	}
+	defer outFD.Close()
 
 	for _, fileMeta := range fileMetas {
-		_, err := outFD.WriteString(FileMetaDataToString(fileMeta))
+		_, err := outFD.WriteString(fileMetaDataLine(fileMeta, inodes[fileMeta.Filename]))
 		if err != nil {
-			log.Fatal("Error During Meta Write Back")
+			return fmt.Errorf("error during meta write back: %w", err)
 		}
 	}
 
-	return nil
+	return outFD.Close()
+}
+
+/*
+	Reading and Writing Local Client State File Related
+*/
+
+// ClientState is what a client remembers about itself between syncs.
+type ClientState struct {
+	ClientId string
+	// Server snapshot time of the last completed sync
+	LastSync int64
+}
+
+// LoadClientState loads the local client state file, creating a
+// fresh client id if the base directory has never been synced.
+func LoadClientState(baseDir string) (*ClientState, error) {
+	state := &ClientState{}
+
+	content, err := ioutil.ReadFile(ConcatPath(baseDir, DEFAULT_STATE_FILENAME))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		items := strings.SplitN(line, CONFIG_DELIMITER, 2)
+		if len(items) != 2 {
+			continue
+		}
+		switch items[0] {
+		case STATE_CLIENT_ID:
+			state.ClientId = items[1]
+		case STATE_LAST_SYNC:
+			state.LastSync, _ = strconv.ParseInt(items[1], 10, 64)
+		}
+	}
+
+	if state.ClientId == "" {
+		id := make([]byte, 16)
+		if _, err := rand.Read(id); err != nil {
+			return nil, err
+		}
+		state.ClientId = hex.EncodeToString(id)
+		state.LastSync = 0
+	}
+	return state, nil
+}
+
+// WriteClientState writes the client state back to the local state file
+func WriteClientState(state *ClientState, baseDir string) error {
+	content := STATE_CLIENT_ID + CONFIG_DELIMITER + state.ClientId + "\n"
+	content += STATE_LAST_SYNC + CONFIG_DELIMITER + strconv.FormatInt(state.LastSync, 10) + "\n"
+	return ioutil.WriteFile(ConcatPath(baseDir, DEFAULT_STATE_FILENAME), []byte(content), 0644)
+}
+
+/*
+	Reading Local Sync Rules File Related
+*/
+
+// SyncRules selects which paths a client syncs. Each line of the rules file is
+// "include,<pattern>" or "exclude,<pattern>", where a pattern is a path, the
+// root of a subtree, or a path.Match glob. With no include rules every path is
+// included; exclude rules always win.
+type SyncRules struct {
+	Include []string
+	Exclude []string
+}
+
+// LoadSyncRules loads the local sync rules file, if there is one
+func LoadSyncRules(baseDir string) (*SyncRules, error) {
+	rules := &SyncRules{}
+
+	content, err := ioutil.ReadFile(ConcatPath(baseDir, DEFAULT_RULES_FILENAME))
+	if err != nil {
+		if os.IsNotExist(err) {
+			return rules, nil
+		}
+		return nil, err
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items := strings.SplitN(line, CONFIG_DELIMITER, 2)
+		if len(items) != 2 || strings.Trim(items[1], "/") == "" {
+			return nil, fmt.Errorf("%v line %v: expected include,<pattern> or exclude,<pattern>", DEFAULT_RULES_FILENAME, i+1)
+		}
+		if _, err := path.Match(items[1], ""); err != nil {
+			return nil, fmt.Errorf("%v line %v: %v", DEFAULT_RULES_FILENAME, i+1, err)
+		}
+		switch items[0] {
+		case RULE_INCLUDE:
+			rules.Include = append(rules.Include, strings.Trim(items[1], "/"))
+		case RULE_EXCLUDE:
+			rules.Exclude = append(rules.Exclude, strings.Trim(items[1], "/"))
+		default:
+			return nil, fmt.Errorf("%v line %v: unknown rule %v", DEFAULT_RULES_FILENAME, i+1, items[0])
+		}
+	}
+	return rules, nil
+}
+
+// Matches reports whether a file is synced under these rules
+func (r *SyncRules) Matches(fileName string) bool {
+	if r.Excludes(fileName) {
+		return false
+	}
+	if len(r.Include) == 0 {
+		return true
+	}
+	for _, pattern := range r.Include {
+		if matchesPattern(pattern, fileName) {
+			return true
+		}
+	}
+	return false
+}
+
+// Excludes reports whether a file or a whole directory is excluded
+func (r *SyncRules) Excludes(fileName string) bool {
+	for _, pattern := range r.Exclude {
+		if matchesPattern(pattern, fileName) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchesPattern(pattern string, fileName string) bool {
+	if fileName == pattern || strings.HasPrefix(fileName, pattern+"/") {
+		return true
+	}
+	matched, _ := path.Match(pattern, fileName)
+	return matched
 }
 
 /*
@@ -147,3 +336,16 @@ func PrintMetaMap(metaMap map[string]*FileMetaData) {
 	fmt.Println("---------END PRINT MAP--------")
 
 }
+
+// logMetaMap logs every entry of a metadata map at debug level, in filename order
+func logMetaMap(logger *Logger, metaMap map[string]*FileMetaData) {
+	fileNames := make([]string, 0, len(metaMap))
+	for fileName := range metaMap {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+	for _, fileName := range fileNames {
+		filemeta := metaMap[fileName]
+		logger.Debug("index entry", "filename", filemeta.Filename, "version", filemeta.Version, "blocks", strings.Join(filemeta.BlockHashList, HASH_DELIMITER))
+	}
+}
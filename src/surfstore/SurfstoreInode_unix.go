@@ -0,0 +1,16 @@
+//go:build !windows
+
+package surfstore
+
+import (
+	"os"
+	"syscall"
+)
+
+// fileInode returns the inode number of a scanned file, or 0 if it is unknown
+func fileInode(info os.FileInfo) uint64 {
+	if stat, ok := info.Sys().(*syscall.Stat_t); ok {
+		return uint64(stat.Ino)
+	}
+	return 0
+}
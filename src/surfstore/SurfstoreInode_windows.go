@@ -0,0 +1,11 @@
+//go:build windows
+
+package surfstore
+
+import "os"
+
+// fileInode returns 0 since Windows has no inode numbers, so the scan cache
+// relies on size and mtime alone
+func fileInode(info os.FileInfo) uint64 {
+	return 0
+}
@@ -15,6 +15,15 @@ type MetaStoreInterface interface {
 
 	// Get the the BlockStore address
 	GetBlockStoreAddr(ctx context.Context, _ *emptypb.Empty) (*BlockStoreAddr, error)
+
+	// Record that a client has applied a FileInfoMap snapshot
+	AckSync(ctx context.Context, syncAck *SyncAck) (*Success, error)
+
+	// Move a file's entry to a new name, keeping its version lineage
+	RenameFile(ctx context.Context, renameRequest *RenameRequest) (*Version, error)
+
+	// Update several files' fileinfo entries all-or-nothing
+	CommitFiles(ctx context.Context, fileCommit *FileCommit) (*CommitResult, error)
 }
 
 type BlockStoreInterface interface {
@@ -30,14 +39,38 @@ type BlockStoreInterface interface {
 	HasBlocks(ctx context.Context, blockHashesIn *BlockHashes) (*BlockHashes, error)
 }
 
+type AdminInterface interface {
+	// Get what the server holds and how long it has been running
+	GetServerStats(ctx context.Context, _ *emptypb.Empty) (*ServerStats, error)
+
+	// List the files of a namespace
+	ListFiles(ctx context.Context, listFilesRequest *ListFilesRequest) (*FileList, error)
+
+	// Get a file's entry and the block store that holds its blocks
+	GetFile(ctx context.Context, fileRequest *FileRequest) (*FileLocation, error)
+
+	// Given a list of hashes, returns the subset stored on this server
+	FindBlocks(ctx context.Context, blockHashes *BlockHashes) (*BlockHashes, error)
+}
+
 type ClientInterface interface {
 	// MetaStore
 	GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error
+	GetFileInfoSnapshot(serverFileInfoMap *map[string]*FileMetaData, snapshotTime *int64, purgeHorizon *int64) error
 	UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error
+	RenameFile(oldFilename string, newFilename string, version int32, latestVersion *int32) error
+	CommitFiles(fileMetaDatas []*FileMetaData, committed *bool, conflicts *[]string, renamedVersions *map[string]int32) error
 	GetBlockStoreAddr(blockStoreAddr *string) error
+	AckSync(clientId string, snapshotTime int64, succ *bool) error
 
 	// BlockStore
 	GetBlock(blockHash string, blockStoreAddr string, block *Block) error
 	PutBlock(block *Block, blockStoreAddr string, succ *bool) error
 	HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error
+
+	// Admin
+	GetServerStats(addr string, stats *ServerStats) error
+	ListFiles(addr string, namespace string, prefix string, includeDeleted bool, files *[]*FileMetaData) error
+	GetFile(addr string, namespace string, fileName string, location *FileLocation) error
+	FindBlocks(addr string, blockHashesIn []string, blockHashesOut *[]string) error
 }
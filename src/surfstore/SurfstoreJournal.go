@@ -0,0 +1,181 @@
+package surfstore
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// JournalEntry is a transfer a sync started and has not finished
+type JournalEntry struct {
+	// ACTION_UPLOAD or ACTION_DOWNLOAD
+	Kind     string
+	Filename string
+	// Digest of the file's block hash list; a transfer only resumes for the same content
+	Content string
+	// Blocks and bytes of a download already verified and written to its partial file
+	Blocks int
+	Bytes  int64
+}
+
+// TransferJournal records the transfers of a sync in the base directory, so the
+// next sync resumes an interrupted one instead of starting over. It is kept in
+// DEFAULT_JOURNAL_FILENAME with a line "<kind>,<content>,<blocks>,<bytes>,<filename>"
+// per transfer. A nil journal records nothing and resumes nothing.
+type TransferJournal struct {
+	baseDir string
+	entries map[string]*JournalEntry
+	saved   time.Time
+	mtx     sync.Mutex
+}
+
+// LoadTransferJournal loads the journal of a base directory; lines it cannot parse are dropped
+func LoadTransferJournal(baseDir string) (*TransferJournal, error) {
+	journal := &TransferJournal{baseDir: baseDir, entries: make(map[string]*JournalEntry)}
+	content, err := ioutil.ReadFile(ConcatPath(baseDir, DEFAULT_JOURNAL_FILENAME))
+	if os.IsNotExist(err) {
+		return journal, nil
+	} else if err != nil {
+		return nil, err
+	}
+	for _, line := range strings.Split(string(content), "\n") {
+		items := strings.SplitN(line, CONFIG_DELIMITER, 5)
+		if len(items) != 5 {
+			continue
+		}
+		blocks, blocksErr := strconv.Atoi(items[2])
+		bytes, bytesErr := strconv.ParseInt(items[3], 10, 64)
+		if blocksErr != nil || bytesErr != nil {
+			continue
+		}
+		journal.entries[items[4]] = &JournalEntry{Kind: items[0], Content: items[1], Blocks: blocks, Bytes: bytes, Filename: items[4]}
+	}
+	return journal, nil
+}
+
+// contentDigest identifies a file's content by its block hash list
+func contentDigest(metaData *FileMetaData) string {
+	digest := sha256.Sum256([]byte(strings.Join(metaData.BlockHashList, HASH_DELIMITER)))
+	return hex.EncodeToString(digest[:])
+}
+
+// Start returns the entry of a transfer of a file's content, resumed if an
+// earlier sync left one for the same content and otherwise new. Files of a
+// single block have nothing to resume and are not recorded.
+func (j *TransferJournal) Start(kind string, metaData *FileMetaData) (entry *JournalEntry, resumed bool) {
+	entry = &JournalEntry{Kind: kind, Filename: metaData.Filename, Content: contentDigest(metaData)}
+	if j == nil || len(metaData.BlockHashList) < 2 {
+		return entry, false
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if prev, ok := j.entries[metaData.Filename]; ok && prev.Kind == kind && prev.Content == entry.Content {
+		return prev, true
+	}
+	j.entries[metaData.Filename] = entry
+	j.save()
+	return entry, false
+}
+
+// Checkpoint saves the progress of the journal's transfers, at most once a
+// second. The partial file of a download must already hold the recorded bytes,
+// so it is synced to the disk first.
+func (j *TransferJournal) Checkpoint(partial *os.File) {
+	if j == nil {
+		return
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if time.Since(j.saved) < time.Second {
+		return
+	}
+	if partial != nil {
+		if err := partial.Sync(); err != nil {
+			return
+		}
+	}
+	j.save()
+}
+
+// Tracks reports whether the journal records a transfer of a file, so a later
+// sync resumes it or prunes it
+func (j *TransferJournal) Tracks(fileName string) bool {
+	if j == nil {
+		return false
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	_, ok := j.entries[fileName]
+	return ok
+}
+
+// Finish forgets the transfer of a file
+func (j *TransferJournal) Finish(fileName string) {
+	if j == nil {
+		return
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	if _, ok := j.entries[fileName]; ok {
+		delete(j.entries, fileName)
+		j.save()
+	}
+}
+
+// Prune forgets the transfers of files a sync no longer transfers, together
+// with the partial files of their downloads
+func (j *TransferJournal) Prune(keep map[string]bool) {
+	if j == nil {
+		return
+	}
+	j.mtx.Lock()
+	defer j.mtx.Unlock()
+	pruned := false
+	for fileName, entry := range j.entries {
+		if keep[fileName] {
+			continue
+		}
+		if entry.Kind == ACTION_DOWNLOAD {
+			os.Remove(partialFilePath(ConcatPath(j.baseDir, fileName)))
+		}
+		delete(j.entries, fileName)
+		pruned = true
+	}
+	if pruned {
+		j.save()
+	}
+}
+
+// save writes the journal, or removes its file once it is empty. A journal
+// that cannot be written only costs resuming, so the failure is just logged.
+// It must be called with j.mtx held.
+func (j *TransferJournal) save() {
+	j.saved = time.Now()
+	path := ConcatPath(j.baseDir, DEFAULT_JOURNAL_FILENAME)
+	if len(j.entries) == 0 {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			DefaultLogger().Warn("cannot remove transfer journal", "path", path, "error", err)
+		}
+		return
+	}
+	fileNames := make([]string, 0, len(j.entries))
+	for fileName := range j.entries {
+		fileNames = append(fileNames, fileName)
+	}
+	sort.Strings(fileNames)
+	content := ""
+	for _, fileName := range fileNames {
+		entry := j.entries[fileName]
+		content += entry.Kind + CONFIG_DELIMITER + entry.Content + CONFIG_DELIMITER + strconv.Itoa(entry.Blocks) + CONFIG_DELIMITER +
+			strconv.FormatInt(entry.Bytes, 10) + CONFIG_DELIMITER + fileName + "\n"
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		DefaultLogger().Warn("cannot write transfer journal", "path", path, "error", err)
+	}
+}
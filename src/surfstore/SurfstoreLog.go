@@ -0,0 +1,199 @@
+package surfstore
+
+import (
+	context "context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+)
+
+var logLevels = map[string]int{LOG_DEBUG: 0, LOG_INFO: 1, LOG_WARN: 2, LOG_ERROR: 3}
+
+// Logger writes leveled log lines with key/value fields, as text or as one
+// JSON object per line. Loggers made by With share the output of their parent.
+type Logger struct {
+	out    io.Writer
+	level  int
+	json   bool
+	fields []interface{}
+	mtx    *sync.Mutex
+}
+
+// NewLogger logs messages of the given level and above to out
+func NewLogger(out io.Writer, level string, asJSON bool) (*Logger, error) {
+	rank, ok := logLevels[level]
+	if !ok {
+		return nil, fmt.Errorf("unknown log level %q, expected debug, info, warn or error", level)
+	}
+	return &Logger{out: out, level: rank, json: asJSON, mtx: &sync.Mutex{}}, nil
+}
+
+var defaultLogger = &Logger{out: os.Stderr, level: logLevels[LOG_INFO], mtx: &sync.Mutex{}}
+var defaultLoggerMtx sync.RWMutex
+
+// DefaultLogger is the logger used where no other one was given
+func DefaultLogger() *Logger {
+	defaultLoggerMtx.RLock()
+	defer defaultLoggerMtx.RUnlock()
+	return defaultLogger
+}
+
+// SetDefaultLogger replaces the default logger. Loggers already derived from
+// the old one, like those of requests in flight, keep logging through it.
+func SetDefaultLogger(logger *Logger) {
+	defaultLoggerMtx.Lock()
+	defer defaultLoggerMtx.Unlock()
+	defaultLogger = logger
+}
+
+// With returns a logger that adds key/value pairs to every line
+func (l *Logger) With(keyValues ...interface{}) *Logger {
+	child := *l
+	child.fields = append(append([]interface{}{}, l.fields...), keyValues...)
+	return &child
+}
+
+// Enabled reports whether messages of a level are written
+func (l *Logger) Enabled(level string) bool {
+	return logLevels[level] >= l.level
+}
+
+func (l *Logger) Debug(msg string, keyValues ...interface{}) {
+	l.log(LOG_DEBUG, msg, keyValues)
+}
+
+func (l *Logger) Info(msg string, keyValues ...interface{}) {
+	l.log(LOG_INFO, msg, keyValues)
+}
+
+func (l *Logger) Warn(msg string, keyValues ...interface{}) {
+	l.log(LOG_WARN, msg, keyValues)
+}
+
+func (l *Logger) Error(msg string, keyValues ...interface{}) {
+	l.log(LOG_ERROR, msg, keyValues)
+}
+
+func (l *Logger) log(level string, msg string, keyValues []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	fields := append(append([]interface{}{}, l.fields...), keyValues...)
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000Z07:00")
+
+	var b strings.Builder
+	if l.json {
+		b.WriteString("{")
+		writeJSONField(&b, "time", now)
+		b.WriteString(",")
+		writeJSONField(&b, "level", level)
+		b.WriteString(",")
+		writeJSONField(&b, "msg", msg)
+		for i := 0; i < len(fields); i += 2 {
+			b.WriteString(",")
+			writeJSONField(&b, fmt.Sprint(fields[i]), fieldValue(fields, i+1))
+		}
+		b.WriteString("}\n")
+	} else {
+		fmt.Fprintf(&b, "%v %-5v %v", now, strings.ToUpper(level), msg)
+		for i := 0; i < len(fields); i += 2 {
+			fmt.Fprintf(&b, " %v=%v", fields[i], quoteIfNeeded(fmt.Sprint(fieldValue(fields, i+1))))
+		}
+		b.WriteString("\n")
+	}
+
+	l.mtx.Lock()
+	defer l.mtx.Unlock()
+	io.WriteString(l.out, b.String())
+}
+
+// fieldValue returns the value of a key/value pair; errors and durations are logged as text
+func fieldValue(fields []interface{}, i int) interface{} {
+	if i >= len(fields) {
+		return "(missing)"
+	}
+	switch value := fields[i].(type) {
+	case error:
+		return value.Error()
+	case time.Duration:
+		return value.String()
+	case fmt.Stringer:
+		return value.String()
+	}
+	return fields[i]
+}
+
+func writeJSONField(b *strings.Builder, key string, value interface{}) {
+	encodedKey, _ := json.Marshal(key)
+	encodedValue, err := json.Marshal(value)
+	if err != nil {
+		encodedValue, _ = json.Marshal(fmt.Sprint(value))
+	}
+	b.Write(encodedKey)
+	b.WriteString(":")
+	b.Write(encodedValue)
+}
+
+func quoteIfNeeded(value string) string {
+	if value == "" || strings.ContainsAny(value, " \t\n\"=") {
+		return strconv.Quote(value)
+	}
+	return value
+}
+
+// NewRequestID returns a random id to correlate the log lines of one request or sync
+func NewRequestID() string {
+	raw := make([]byte, 8)
+	rand.Read(raw)
+	return hex.EncodeToString(raw)
+}
+
+type loggerKey struct{}
+
+// ContextWithLogger attaches a logger to a context
+func ContextWithLogger(ctx context.Context, logger *Logger) context.Context {
+	return context.WithValue(ctx, loggerKey{}, logger)
+}
+
+// LoggerFrom returns the logger of a context, or the default logger
+func LoggerFrom(ctx context.Context) *Logger {
+	if logger, ok := ctx.Value(loggerKey{}).(*Logger); ok {
+		return logger
+	}
+	return DefaultLogger()
+}
+
+// LoggingInterceptor gives every RPC a logger tagged with its request id, the
+// one sent by the client or a new one, and logs how the RPC ended
+func LoggingInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	requestID := ""
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(REQUEST_ID_METADATA_KEY); len(values) > 0 && len(values[0]) <= 64 {
+			requestID = values[0]
+		}
+	}
+	if requestID == "" {
+		requestID = NewRequestID()
+	}
+	logger := DefaultLogger().With("request_id", requestID, "method", info.FullMethod)
+
+	start := time.Now()
+	resp, err := handler(ContextWithLogger(ctx, logger), req)
+	if err != nil {
+		logger.Warn("request failed", "code", status.Code(err), "error", status.Convert(err).Message(), "duration", time.Since(start))
+	} else {
+		logger.Debug("request handled", "duration", time.Since(start))
+	}
+	return resp, err
+}
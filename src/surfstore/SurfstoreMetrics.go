@@ -0,0 +1,159 @@
+package surfstore
+
+import (
+	context "context"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/status"
+)
+
+// Upper bounds in seconds of the RPC latency histogram buckets
+var latencyBuckets = []float64{0.0005, 0.001, 0.0025, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+
+type histogram struct {
+	counts []int64
+	count  int64
+	sum    float64
+}
+
+func (h *histogram) observe(seconds float64) {
+	for i, bound := range latencyBuckets {
+		if seconds <= bound {
+			h.counts[i] += 1
+		}
+	}
+	h.count += 1
+	h.sum += seconds
+}
+
+type rpcKey struct {
+	service string
+	method  string
+	code    string
+}
+
+// Metrics counts the RPCs of a server and serves them, together with the
+// state of its MetaStore and BlockStore, in the Prometheus text format.
+type Metrics struct {
+	// Either may be nil if the server does not run that service
+	MetaStore  *MetaStore
+	BlockStore *BlockStore
+	handled    map[rpcKey]int64
+	latencies  map[rpcKey]*histogram
+	mtx        sync.Mutex
+}
+
+func NewMetrics(metaStore *MetaStore, blockStore *BlockStore) *Metrics {
+	return &Metrics{
+		MetaStore:  metaStore,
+		BlockStore: blockStore,
+		handled:    make(map[rpcKey]int64),
+		latencies:  make(map[rpcKey]*histogram),
+	}
+}
+
+// UnaryInterceptor records the outcome and latency of every unary RPC
+func (m *Metrics) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	start := time.Now()
+	resp, err := handler(ctx, req)
+	elapsed := time.Since(start).Seconds()
+
+	// FullMethod is /package.Service/Method
+	service, method := "", info.FullMethod
+	if i := strings.LastIndex(info.FullMethod, "/"); i > 0 {
+		service, method = info.FullMethod[1:i], info.FullMethod[i+1:]
+	}
+	m.mtx.Lock()
+	defer m.mtx.Unlock()
+	m.handled[rpcKey{service: service, method: method, code: status.Code(err).String()}] += 1
+	key := rpcKey{service: service, method: method}
+	if _, ok := m.latencies[key]; !ok {
+		m.latencies[key] = &histogram{counts: make([]int64, len(latencyBuckets))}
+	}
+	m.latencies[key].observe(elapsed)
+	return resp, err
+}
+
+func (m *Metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteTo(w)
+}
+
+// WriteTo writes every metric in the Prometheus text format
+func (m *Metrics) WriteTo(w io.Writer) (int64, error) {
+	var b strings.Builder
+	m.mtx.Lock()
+	handledKeys := make([]rpcKey, 0, len(m.handled))
+	for key := range m.handled {
+		handledKeys = append(handledKeys, key)
+	}
+	sortKeys(handledKeys)
+	writeHeader(&b, "surfstore_grpc_handled_total", "counter", "RPCs completed by the server, by method and status code")
+	for _, key := range handledKeys {
+		fmt.Fprintf(&b, "surfstore_grpc_handled_total{grpc_service=%q,grpc_method=%q,grpc_code=%q} %v\n", key.service, key.method, key.code, m.handled[key])
+	}
+
+	latencyKeys := make([]rpcKey, 0, len(m.latencies))
+	for key := range m.latencies {
+		latencyKeys = append(latencyKeys, key)
+	}
+	sortKeys(latencyKeys)
+	writeHeader(&b, "surfstore_grpc_handling_seconds", "histogram", "Time the server took to handle RPCs, by method")
+	for _, key := range latencyKeys {
+		h := m.latencies[key]
+		labels := fmt.Sprintf("grpc_service=%q,grpc_method=%q", key.service, key.method)
+		for i, bound := range latencyBuckets {
+			fmt.Fprintf(&b, "surfstore_grpc_handling_seconds_bucket{%v,le=\"%v\"} %v\n", labels, bound, h.counts[i])
+		}
+		fmt.Fprintf(&b, "surfstore_grpc_handling_seconds_bucket{%v,le=\"+Inf\"} %v\n", labels, h.count)
+		fmt.Fprintf(&b, "surfstore_grpc_handling_seconds_sum{%v} %v\n", labels, h.sum)
+		fmt.Fprintf(&b, "surfstore_grpc_handling_seconds_count{%v} %v\n", labels, h.count)
+	}
+	m.mtx.Unlock()
+
+	if m.MetaStore != nil {
+		stats := m.MetaStore.Stats()
+		writeGauge(&b, "surfstore_files", "Files on the MetaStore, without deleted files", stats.Files)
+		writeGauge(&b, "surfstore_tombstones", "Deleted files the MetaStore still remembers", stats.Tombstones)
+		writeGauge(&b, "surfstore_namespaces", "Namespaces on the MetaStore", stats.Namespaces)
+		writeHeader(&b, "surfstore_version_conflicts_total", "counter", "File updates rejected because the MetaStore had a newer version")
+		fmt.Fprintf(&b, "surfstore_version_conflicts_total %v\n", stats.Conflicts)
+	}
+	if m.BlockStore != nil {
+		stats := m.BlockStore.Stats()
+		writeGauge(&b, "surfstore_blocks", "Blocks on the BlockStore", stats.Blocks)
+		writeGauge(&b, "surfstore_block_raw_bytes", "Size of the stored blocks before compression", stats.RawBytes)
+		writeGauge(&b, "surfstore_block_stored_bytes", "Size of the stored blocks after compression", stats.StoredBytes)
+	}
+
+	n, err := io.WriteString(w, b.String())
+	return int64(n), err
+}
+
+func writeHeader(b *strings.Builder, name string, kind string, help string) {
+	fmt.Fprintf(b, "# HELP %v %v\n# TYPE %v %v\n", name, help, name, kind)
+}
+
+func writeGauge(b *strings.Builder, name string, help string, value int64) {
+	writeHeader(b, name, "gauge", help)
+	fmt.Fprintf(b, "%v %v\n", name, value)
+}
+
+func sortKeys(keys []rpcKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].service != keys[j].service {
+			return keys[i].service < keys[j].service
+		}
+		if keys[i].method != keys[j].method {
+			return keys[i].method < keys[j].method
+		}
+		return keys[i].code < keys[j].code
+	})
+}
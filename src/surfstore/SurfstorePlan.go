@@ -0,0 +1,276 @@
+package surfstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+
+	"google.golang.org/protobuf/proto"
+)
+
+// SyncAction is one change a sync makes to the base directory or the server
+type SyncAction struct {
+	Action      string `json:"action"`
+	Filename    string `json:"filename"`
+	NewFilename string `json:"newFilename,omitempty"`
+	Version     int32  `json:"version"`
+	Bytes       int64  `json:"bytes"`
+	// Local changes are discarded because the server has a newer version
+	Conflict bool `json:"conflict,omitempty"`
+}
+
+// SyncPlan is everything a sync will do, in the order it does it
+type SyncPlan struct {
+	Actions       []SyncAction `json:"actions"`
+	UploadBytes   int64        `json:"uploadBytes"`
+	DownloadBytes int64        `json:"downloadBytes"`
+	Conflicts     int          `json:"conflicts"`
+	FullReconcile bool         `json:"fullReconcile"`
+}
+
+// FileResult is what happened when a planned action was carried out
+type FileResult struct {
+	SyncAction
+	Outcome string `json:"outcome"`
+	Err     error  `json:"-"`
+}
+
+// SyncResult is the outcome of a whole sync
+type SyncResult struct {
+	Plan  *SyncPlan
+	Files []FileResult
+	// The most severe error of the sync, nil if every action succeeded
+	Err error
+}
+
+func (result *SyncResult) record(action SyncAction, err error) {
+	outcome := OUTCOME_OK
+	if ErrorKind(err) == ERR_CONFLICT {
+		outcome = OUTCOME_CONFLICT
+	} else if ErrorKind(err) == ERR_PERMISSION {
+		outcome = OUTCOME_DENIED
+	} else if err != nil {
+		outcome = OUTCOME_FAILED
+	}
+	result.Files = append(result.Files, FileResult{SyncAction: action, Outcome: outcome, Err: err})
+	result.Err = moreSevere(result.Err, err)
+}
+
+// Failed returns the results that did not succeed
+func (result *SyncResult) Failed() []FileResult {
+	failed := make([]FileResult, 0)
+	for _, file := range result.Files {
+		if file.Outcome != OUTCOME_OK {
+			failed = append(failed, file)
+		}
+	}
+	return failed
+}
+
+// appliedRemote reports whether every change from the server was applied locally
+func (result *SyncResult) appliedRemote() bool {
+	for _, file := range result.Files {
+		switch file.Action {
+		case ACTION_DELETE_LOCAL, ACTION_RENAME_LOCAL, ACTION_DOWNLOAD:
+			if file.Outcome == OUTCOME_FAILED {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Actions run in this order; the order of files within an action does not matter
+var actionOrder = []string{
+	ACTION_DELETE_LOCAL,
+	ACTION_RENAME_REMOTE,
+	ACTION_RENAME_LOCAL,
+	ACTION_DOWNLOAD,
+	ACTION_UPLOAD,
+	ACTION_DELETE_REMOTE,
+}
+
+func (plan *SyncPlan) add(action SyncAction) {
+	plan.Actions = append(plan.Actions, action)
+	switch action.Action {
+	case ACTION_DOWNLOAD:
+		plan.DownloadBytes += action.Bytes
+	case ACTION_UPLOAD:
+		plan.UploadBytes += action.Bytes
+	}
+	if action.Conflict {
+		plan.Conflicts += 1
+	}
+}
+
+// Count returns how many actions of a kind the plan has
+func (plan *SyncPlan) Count(kind string) int {
+	count := 0
+	for _, action := range plan.Actions {
+		if action.Action == kind {
+			count += 1
+		}
+	}
+	return count
+}
+
+// planSync decides what a sync has to do once the base directory has been
+// scanned and local deletions marked. Changes that need no transfer are made
+// to the in-memory local index right away; everything that touches the base
+// directory or the server is only recorded, so a dry run changes nothing.
+func planSync(localIndex map[string]*FileMetaData, remoteIndex map[string]*FileMetaData, currFiles map[string][]string, changedFiles map[string]bool, renames []SyncAction, fullReconcile bool) *SyncPlan {
+	plan := &SyncPlan{Actions: make([]SyncAction, 0), FullReconcile: fullReconcile}
+	handled := make(map[string]bool)
+
+	if fullReconcile {
+		for fileName, localdata := range localIndex {
+			if changedFiles[fileName] {
+				continue
+			}
+			delete(localIndex, fileName)
+			if _, ok := remoteIndex[fileName]; ok || IsDeleted(localdata.BlockHashList) {
+				continue
+			}
+			// Unchanged since the last sync and gone from the server: its tombstone was purged
+			plan.add(SyncAction{Action: ACTION_DELETE_LOCAL, Filename: fileName, Version: localdata.Version})
+		}
+	}
+
+	for _, rename := range renames {
+		plan.add(rename)
+		handled[rename.Filename] = true
+		handled[rename.NewFilename] = true
+	}
+
+	// Apply renames made by other clients before downloads so a moved file is not fetched again
+	for fileName, remotedata := range remoteIndex {
+		if remotedata.RenamedTo == "" || changedFiles[fileName] || handled[fileName] || handled[remotedata.RenamedTo] {
+			continue
+		}
+		if canRenameLocal(localIndex, remoteIndex, currFiles, fileName) {
+			plan.add(SyncAction{
+				Action:      ACTION_RENAME_LOCAL,
+				Filename:    fileName,
+				NewFilename: remotedata.RenamedTo,
+				Version:     remoteIndex[remotedata.RenamedTo].Version,
+			})
+			handled[fileName] = true
+			handled[remotedata.RenamedTo] = true
+		}
+	}
+
+	for fileName, remotedata := range remoteIndex {
+		if handled[fileName] {
+			continue
+		}
+		localdata, isUsed := localIndex[fileName]
+		if isUsed {
+			if remotedata.Version < localdata.Version {
+				continue
+			}
+			if remotedata.Version == localdata.Version && isSameBlock(localdata.BlockHashList, remotedata.BlockHashList) {
+				continue
+			}
+		} else if hashList, ok := currFiles[fileName]; ok && isSameBlock(hashList, remotedata.BlockHashList) {
+			// The local copy already has the server's content
+			localIndex[fileName] = proto.Clone(remotedata).(*FileMetaData)
+			continue
+		}
+
+		handled[fileName] = true
+		if _, ok := currFiles[fileName]; !ok && IsDeleted(remotedata.BlockHashList) {
+			// Deleted on the server and not here either
+			localIndex[fileName] = proto.Clone(remotedata).(*FileMetaData)
+			continue
+		}
+		action := SyncAction{
+			Action:   ACTION_DOWNLOAD,
+			Filename: fileName,
+			Version:  remotedata.Version,
+			Bytes:    remotedata.Size,
+			Conflict: changedFiles[fileName],
+		}
+		if IsDeleted(remotedata.BlockHashList) {
+			action.Action = ACTION_DELETE_LOCAL
+			action.Bytes = 0
+		}
+		plan.add(action)
+	}
+
+	for fileName, localdata := range localIndex {
+		if handled[fileName] {
+			continue
+		}
+		remotedata, isUsed := remoteIndex[fileName]
+		if isUsed {
+			if remotedata.Version >= localdata.Version {
+				continue
+			}
+		} else if IsDeleted(localdata.BlockHashList) {
+			// Nothing left on the server to delete, either never uploaded or already purged
+			delete(localIndex, fileName)
+			continue
+		}
+		if IsDeleted(localdata.BlockHashList) {
+			plan.add(SyncAction{Action: ACTION_DELETE_REMOTE, Filename: fileName, Version: localdata.Version})
+		} else {
+			plan.add(SyncAction{Action: ACTION_UPLOAD, Filename: fileName, Version: localdata.Version, Bytes: localdata.Size})
+		}
+	}
+
+	sort.SliceStable(plan.Actions, func(i, j int) bool {
+		a, b := plan.Actions[i], plan.Actions[j]
+		if a.Action != b.Action {
+			return actionRank(a.Action) < actionRank(b.Action)
+		}
+		return a.Filename < b.Filename
+	})
+	return plan
+}
+
+func actionRank(kind string) int {
+	for i, action := range actionOrder {
+		if action == kind {
+			return i
+		}
+	}
+	return len(actionOrder)
+}
+
+// PrintSyncPlan writes a sync plan as human readable text, or as JSON
+func PrintSyncPlan(w io.Writer, plan *SyncPlan, asJSON bool) error {
+	if asJSON {
+		encoder := json.NewEncoder(w)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(plan)
+	}
+
+	if plan.FullReconcile {
+		fmt.Fprintln(w, "Tombstones were purged since the last sync, the whole base directory is reconciled with the server.")
+	}
+	if len(plan.Actions) == 0 {
+		fmt.Fprintln(w, "Nothing to sync.")
+		return nil
+	}
+	for _, action := range plan.Actions {
+		line := fmt.Sprintf("%-14s %v", action.Action, action.Filename)
+		if action.NewFilename != "" {
+			line += " -> " + action.NewFilename
+		}
+		if action.Bytes > 0 {
+			line += fmt.Sprintf(" (%v bytes)", action.Bytes)
+		}
+		if action.Conflict {
+			line += " [conflict: local changes will be replaced by version " + fmt.Sprint(action.Version) + "]"
+		}
+		fmt.Fprintln(w, line)
+	}
+
+	fmt.Fprintf(w, "\n%v uploads, %v downloads, %v local deletions, %v remote deletions, %v renames, %v conflicts\n",
+		plan.Count(ACTION_UPLOAD), plan.Count(ACTION_DOWNLOAD),
+		plan.Count(ACTION_DELETE_LOCAL), plan.Count(ACTION_DELETE_REMOTE),
+		plan.Count(ACTION_RENAME_LOCAL)+plan.Count(ACTION_RENAME_REMOTE), plan.Conflicts)
+	_, err := fmt.Fprintf(w, "%v bytes to upload, %v bytes to download\n", plan.UploadBytes, plan.DownloadBytes)
+	return err
+}
@@ -0,0 +1,247 @@
+package surfstore
+
+import (
+	"reflect"
+	"testing"
+)
+
+// testFile is an index entry for a file with the given blocks
+func testFile(fileName string, version int32, hashes ...string) *FileMetaData {
+	return &FileMetaData{Filename: fileName, Version: version, BlockHashList: hashes}
+}
+
+// testIndex builds an index from entries
+func testIndex(files ...*FileMetaData) map[string]*FileMetaData {
+	index := make(map[string]*FileMetaData)
+	for _, file := range files {
+		index[file.Filename] = file
+	}
+	return index
+}
+
+func TestPlanSync(t *testing.T) {
+	renamedA := testFile("a", 2, "0")
+	renamedA.RenamedTo = "b"
+
+	for _, test := range []struct {
+		name          string
+		local         map[string]*FileMetaData
+		remote        map[string]*FileMetaData
+		currFiles     map[string][]string
+		changed       map[string]bool
+		renames       []SyncAction
+		fullReconcile bool
+		want          []SyncAction
+		// Versions of the local index entries once planned, nil to not check them
+		wantIndex map[string]int32
+	}{
+		{
+			name:      "in sync",
+			local:     testIndex(testFile("a", 1, "h1")),
+			remote:    testIndex(testFile("a", 1, "h1")),
+			currFiles: map[string][]string{"a": {"h1"}},
+			want:      []SyncAction{},
+		},
+		{
+			name:      "new local file",
+			local:     testIndex(testFile("a", 1, "h1")),
+			remote:    testIndex(),
+			currFiles: map[string][]string{"a": {"h1"}},
+			changed:   map[string]bool{"a": true},
+			want:      []SyncAction{{Action: ACTION_UPLOAD, Filename: "a", Version: 1}},
+		},
+		{
+			name:      "newer on the server",
+			local:     testIndex(testFile("a", 1, "h1")),
+			remote:    testIndex(testFile("a", 2, "h2")),
+			currFiles: map[string][]string{"a": {"h1"}},
+			want:      []SyncAction{{Action: ACTION_DOWNLOAD, Filename: "a", Version: 2}},
+		},
+		{
+			name:      "changed on both sides",
+			local:     testIndex(testFile("a", 2, "h2")),
+			remote:    testIndex(testFile("a", 2, "h3")),
+			currFiles: map[string][]string{"a": {"h2"}},
+			changed:   map[string]bool{"a": true},
+			want:      []SyncAction{{Action: ACTION_DOWNLOAD, Filename: "a", Version: 2, Conflict: true}},
+		},
+		{
+			name:      "deleted on the server",
+			local:     testIndex(testFile("a", 1, "h1")),
+			remote:    testIndex(testFile("a", 2, "0")),
+			currFiles: map[string][]string{"a": {"h1"}},
+			want:      []SyncAction{{Action: ACTION_DELETE_LOCAL, Filename: "a", Version: 2}},
+		},
+		{
+			name:      "deleted locally",
+			local:     testIndex(testFile("a", 2, "0")),
+			remote:    testIndex(testFile("a", 1, "h1")),
+			currFiles: map[string][]string{},
+			changed:   map[string]bool{"a": true},
+			want:      []SyncAction{{Action: ACTION_DELETE_REMOTE, Filename: "a", Version: 2}},
+		},
+		{
+			name:      "deleted on both sides",
+			local:     testIndex(),
+			remote:    testIndex(testFile("a", 2, "0")),
+			currFiles: map[string][]string{},
+			want:      []SyncAction{},
+			wantIndex: map[string]int32{"a": 2},
+		},
+		{
+			name:      "local copy already has the server's content",
+			local:     testIndex(),
+			remote:    testIndex(testFile("a", 3, "h1")),
+			currFiles: map[string][]string{"a": {"h1"}},
+			want:      []SyncAction{},
+			wantIndex: map[string]int32{"a": 3},
+		},
+		{
+			name:      "renamed on the server",
+			local:     testIndex(testFile("a", 1, "h1")),
+			remote:    testIndex(renamedA, testFile("b", 1, "h1")),
+			currFiles: map[string][]string{"a": {"h1"}},
+			want:      []SyncAction{{Action: ACTION_RENAME_LOCAL, Filename: "a", NewFilename: "b", Version: 1}},
+		},
+		{
+			name:      "renamed on the server onto an existing local file",
+			local:     testIndex(testFile("a", 1, "h1")),
+			remote:    testIndex(renamedA, testFile("b", 1, "h1")),
+			currFiles: map[string][]string{"a": {"h1"}, "b": {"h2"}},
+			changed:   map[string]bool{"b": true},
+			want: []SyncAction{
+				{Action: ACTION_DELETE_LOCAL, Filename: "a", Version: 2},
+				{Action: ACTION_DOWNLOAD, Filename: "b", Version: 1, Conflict: true},
+			},
+		},
+		{
+			name:      "renamed locally",
+			local:     testIndex(testFile("a", 2, "0"), testFile("b", 1, "h1")),
+			remote:    testIndex(testFile("a", 1, "h1")),
+			currFiles: map[string][]string{"b": {"h1"}},
+			changed:   map[string]bool{"a": true, "b": true},
+			renames:   []SyncAction{{Action: ACTION_RENAME_REMOTE, Filename: "a", NewFilename: "b", Version: 1}},
+			want:      []SyncAction{{Action: ACTION_RENAME_REMOTE, Filename: "a", NewFilename: "b", Version: 1}},
+		},
+		{
+			name:      "actions run in order",
+			local:     testIndex(testFile("a", 1, "h1"), testFile("b", 2, "0"), testFile("c", 1, "h3")),
+			remote:    testIndex(testFile("a", 2, "h2"), testFile("b", 1, "h2"), testFile("d", 1, "h4")),
+			currFiles: map[string][]string{"a": {"h1"}, "c": {"h3"}},
+			changed:   map[string]bool{"b": true, "c": true},
+			want: []SyncAction{
+				{Action: ACTION_DOWNLOAD, Filename: "a", Version: 2},
+				{Action: ACTION_DOWNLOAD, Filename: "d", Version: 1},
+				{Action: ACTION_UPLOAD, Filename: "c", Version: 1},
+				{Action: ACTION_DELETE_REMOTE, Filename: "b", Version: 2},
+			},
+		},
+		{
+			name:          "full reconcile deletes files whose tombstone was purged",
+			local:         testIndex(testFile("a", 1, "h1"), testFile("b", 1, "h2")),
+			remote:        testIndex(),
+			currFiles:     map[string][]string{"a": {"h1"}, "b": {"h2"}},
+			changed:       map[string]bool{"b": true},
+			fullReconcile: true,
+			want: []SyncAction{
+				{Action: ACTION_DELETE_LOCAL, Filename: "a", Version: 1},
+				{Action: ACTION_UPLOAD, Filename: "b", Version: 1},
+			},
+		},
+		{
+			name:          "full reconcile keeps what the server still has",
+			local:         testIndex(testFile("a", 1, "h1"), testFile("b", 1, "h2")),
+			remote:        testIndex(testFile("a", 1, "h1"), testFile("b", 3, "h3")),
+			currFiles:     map[string][]string{"a": {"h1"}, "b": {"h2"}},
+			fullReconcile: true,
+			want:          []SyncAction{{Action: ACTION_DOWNLOAD, Filename: "b", Version: 3}},
+			wantIndex:     map[string]int32{"a": 1},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			plan := planSync(test.local, test.remote, test.currFiles, test.changed, test.renames, test.fullReconcile)
+			if !reflect.DeepEqual(plan.Actions, test.want) {
+				t.Errorf("actions = %+v, want %+v", plan.Actions, test.want)
+			}
+			if plan.FullReconcile != test.fullReconcile {
+				t.Errorf("FullReconcile = %v, want %v", plan.FullReconcile, test.fullReconcile)
+			}
+			if test.wantIndex == nil {
+				return
+			}
+			versions := make(map[string]int32)
+			for fileName, localdata := range test.local {
+				versions[fileName] = localdata.Version
+			}
+			if !reflect.DeepEqual(versions, test.wantIndex) {
+				t.Errorf("local index versions = %v, want %v", versions, test.wantIndex)
+			}
+		})
+	}
+}
+
+func TestDetectRenames(t *testing.T) {
+	for _, test := range []struct {
+		name      string
+		local     map[string]*FileMetaData
+		currFiles map[string][]string
+		newFiles  map[string]bool
+		want      map[string]string
+	}{
+		{
+			name:      "moved",
+			local:     testIndex(testFile("a", 1, "h1", "h2")),
+			currFiles: map[string][]string{"b": {"h1", "h2"}},
+			newFiles:  map[string]bool{"b": true},
+			want:      map[string]string{"a": "b"},
+		},
+		{
+			name:      "content changed",
+			local:     testIndex(testFile("a", 1, "h1", "h2")),
+			currFiles: map[string][]string{"b": {"h1", "h3"}},
+			newFiles:  map[string]bool{"b": true},
+			want:      map[string]string{},
+		},
+		{
+			name:      "two new files with the content",
+			local:     testIndex(testFile("a", 1, "h1")),
+			currFiles: map[string][]string{"b": {"h1"}, "c": {"h1"}},
+			newFiles:  map[string]bool{"b": true, "c": true},
+			want:      map[string]string{},
+		},
+		{
+			name:      "two removed files with the content",
+			local:     testIndex(testFile("a", 1, "h1"), testFile("b", 1, "h1")),
+			currFiles: map[string][]string{"c": {"h1"}},
+			newFiles:  map[string]bool{"c": true},
+			want:      map[string]string{},
+		},
+		{
+			name:      "empty file",
+			local:     testIndex(testFile("a", 1)),
+			currFiles: map[string][]string{"b": {}},
+			newFiles:  map[string]bool{"b": true},
+			want:      map[string]string{},
+		},
+		{
+			name:      "already deleted",
+			local:     testIndex(testFile("a", 2, "0")),
+			currFiles: map[string][]string{"b": {"0"}},
+			newFiles:  map[string]bool{"b": true},
+			want:      map[string]string{},
+		},
+		{
+			name:      "still there",
+			local:     testIndex(testFile("a", 1, "h1")),
+			currFiles: map[string][]string{"a": {"h1"}, "b": {"h1"}},
+			newFiles:  map[string]bool{"b": true},
+			want:      map[string]string{},
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			if got := detectRenames(test.local, test.currFiles, test.newFiles); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("detectRenames = %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package surfstore
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+// ProgressEvent is how far a sync has got. Events are reported while the base
+// directory is scanned, while the planned actions are carried out, and once
+// more when the sync is done.
+type ProgressEvent struct {
+	// PROGRESS_SCAN, PROGRESS_TRANSFER or PROGRESS_DONE
+	Phase string `json:"phase"`
+	// Files of the base directory scanned so far, and found in it
+	FilesScanned int `json:"filesScanned"`
+	FilesFound   int `json:"filesFound"`
+	// Actions carried out so far, and planned in all
+	ActionsDone  int `json:"actionsDone"`
+	ActionsTotal int `json:"actionsTotal"`
+	// Blocks and bytes of the planned uploads and downloads that are done,
+	// including those an interrupted sync already transferred
+	BlocksDone  int   `json:"blocksDone"`
+	BlocksTotal int   `json:"blocksTotal"`
+	BytesDone   int64 `json:"bytesDone"`
+	BytesTotal  int64 `json:"bytesTotal"`
+	// Time since the sync started
+	Elapsed time.Duration `json:"-"`
+	// Estimated time until the transfers are done, negative while unknown
+	ETA time.Duration `json:"-"`
+}
+
+// ProgressReporter is told how a sync is getting on. Calls come from the
+// syncing goroutine, one at a time.
+type ProgressReporter interface {
+	Progress(event ProgressEvent)
+}
+
+// progressTracker counts what a sync has done and reports it, at most once per
+// PROGRESS_INTERVAL within a phase. A nil tracker reports nothing.
+type progressTracker struct {
+	reporter ProgressReporter
+	event    ProgressEvent
+	started  time.Time
+	// When the transfer phase started, and the bytes done since then without
+	// transferring them, which the transfer rate leaves out
+	transferStarted time.Time
+	skippedBytes    int64
+	reported        time.Time
+	mtx             sync.Mutex
+}
+
+func newProgressTracker(reporter ProgressReporter) *progressTracker {
+	if reporter == nil {
+		return nil
+	}
+	return &progressTracker{reporter: reporter, started: time.Now()}
+}
+
+// startScan reports that the base directory is being scanned for its files
+func (t *progressTracker) startScan(found int) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.event.Phase = PROGRESS_SCAN
+	t.event.FilesFound = found
+	t.report(true)
+}
+
+func (t *progressTracker) fileScanned() {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.event.FilesScanned += 1
+	t.report(false)
+}
+
+// startTransfer reports that the planned actions are being carried out
+func (t *progressTracker) startTransfer() {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.event.Phase = PROGRESS_TRANSFER
+	t.transferStarted = time.Now()
+	t.report(true)
+}
+
+// addPlanned adds actions and the blocks and bytes they transfer to the totals
+func (t *progressTracker) addPlanned(actions int, blocks int, bytes int64) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.event.ActionsTotal += actions
+	t.event.BlocksTotal += blocks
+	t.event.BytesTotal += bytes
+}
+
+// blocksDone counts blocks that were uploaded or downloaded, or that did not
+// need to be because the other side already had them
+func (t *progressTracker) blocksDone(blocks int, bytes int64, transferred bool) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.event.BlocksDone += blocks
+	t.event.BytesDone += bytes
+	if !transferred {
+		t.skippedBytes += bytes
+	}
+	t.report(false)
+}
+
+func (t *progressTracker) actionDone() {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.event.ActionsDone += 1
+	t.report(false)
+}
+
+// finish reports that the sync is done, whether or not every action succeeded
+func (t *progressTracker) finish() {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.event.Phase = PROGRESS_DONE
+	t.report(true)
+}
+
+// report hands the counts to the reporter unless it had them too recently. It
+// must be called with t.mtx held.
+func (t *progressTracker) report(force bool) {
+	now := time.Now()
+	if !force && now.Sub(t.reported) < PROGRESS_INTERVAL {
+		return
+	}
+	t.reported = now
+	t.event.Elapsed = now.Sub(t.started)
+	t.event.ETA = -1
+	if t.event.Phase == PROGRESS_DONE {
+		t.event.ETA = 0
+	} else if transferred := t.event.BytesDone - t.skippedBytes; t.event.Phase == PROGRESS_TRANSFER && transferred > 0 {
+		remaining := t.event.BytesTotal - t.event.BytesDone
+		if remaining < 0 {
+			remaining = 0
+		}
+		t.event.ETA = time.Duration(float64(now.Sub(t.transferStarted)) * float64(remaining) / float64(transferred))
+	}
+	t.reporter.Progress(t.event)
+}
+
+// ProgressBar draws the progress of a sync on one line of a terminal,
+// redrawing it in place, and ends the line once the sync is done
+type ProgressBar struct {
+	w io.Writer
+}
+
+func NewProgressBar(w io.Writer) *ProgressBar {
+	return &ProgressBar{w: w}
+}
+
+func (b *ProgressBar) Progress(event ProgressEvent) {
+	var line string
+	if event.Phase == PROGRESS_SCAN {
+		line = fmt.Sprintf("scanning %v/%v files", event.FilesScanned, event.FilesFound)
+	} else {
+		// Bytes measure the progress best, actions are all there is when nothing is transferred
+		fraction := 1.0
+		if event.BytesTotal > 0 {
+			fraction = float64(event.BytesDone) / float64(event.BytesTotal)
+		} else if event.ActionsTotal > 0 {
+			fraction = float64(event.ActionsDone) / float64(event.ActionsTotal)
+		}
+		if fraction > 1 {
+			fraction = 1
+		}
+		filled := int(fraction * float64(PROGRESS_BAR_WIDTH))
+		line = fmt.Sprintf("[%s%s] %3.0f%% %v/%v files %v/%v",
+			strings.Repeat("=", filled), strings.Repeat(" ", PROGRESS_BAR_WIDTH-filled), fraction*100,
+			event.ActionsDone, event.ActionsTotal, formatBytes(event.BytesDone), formatBytes(event.BytesTotal))
+		if event.Phase == PROGRESS_DONE {
+			line += " in " + event.Elapsed.Round(time.Second).String()
+		} else if event.ETA >= 0 {
+			// Rounded up, so a transfer that is not done never shows 0s to go
+			line += " ETA " + (event.ETA + time.Second - 1).Truncate(time.Second).String()
+		}
+	}
+	// Return to the start of the line and clear what is left of the previous one
+	fmt.Fprintf(b.w, "\r%s\x1b[K", line)
+	if event.Phase == PROGRESS_DONE {
+		fmt.Fprintln(b.w)
+	}
+}
+
+// formatBytes writes a byte count with a binary unit, e.g. 1.5 MiB
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%v B", n)
+	}
+	value, exp := float64(n)/unit, 0
+	for value >= unit && exp < 4 {
+		value /= unit
+		exp += 1
+	}
+	return fmt.Sprintf("%.1f %ciB", value, "KMGTP"[exp])
+}
+
+// ProgressJSON writes every progress event as a JSON object on a line of its
+// own, for programs that follow a sync
+type ProgressJSON struct {
+	encoder *json.Encoder
+}
+
+func NewProgressJSON(w io.Writer) *ProgressJSON {
+	return &ProgressJSON{encoder: json.NewEncoder(w)}
+}
+
+func (p *ProgressJSON) Progress(event ProgressEvent) {
+	line := struct {
+		ProgressEvent
+		ElapsedSeconds float64  `json:"elapsedSeconds"`
+		ETASeconds     *float64 `json:"etaSeconds,omitempty"`
+	}{ProgressEvent: event, ElapsedSeconds: event.Elapsed.Seconds()}
+	if event.ETA >= 0 {
+		eta := event.ETA.Seconds()
+		line.ETASeconds = &eta
+	}
+	// Progress is only informational, a reader that went away does not fail the sync
+	p.encoder.Encode(line)
+}
@@ -3,9 +3,15 @@ package surfstore
 import (
 	context "context"
 	"fmt"
+	"strings"
 	"time"
 
 	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 	"google.golang.org/protobuf/types/known/emptypb"
 )
 
@@ -13,12 +19,109 @@ type RPCClient struct {
 	MetaStoreAddr string
 	BaseDir       string
 	BlockSize     int
+	// Commit all file updates of a sync in one all-or-nothing transaction
+	Atomic bool
+	// Hash every file even if its size, mtime and inode match the local index
+	Rehash bool
+	// Only print what a sync would do, as JSON if PlanJSON is set
+	DryRun   bool
+	PlanJSON bool
+	// TLS credentials for every connection, nil for plain text
+	Credentials credentials.TransportCredentials
+	// Token identifying the user to the MetaStore, empty if it does not require one
+	Token string
+	// Passphrase that blocks and filenames are encrypted with, empty for no encryption
+	Passphrase string
+	// Set up from the passphrase at the start of a sync; nil until then or without encryption
+	Cipher *Cipher
+	// Gzip block transfers when the block store supports it
+	Compress bool
+	// Limit the block bytes sent and received per second, across every
+	// transfer of the client; nil for no limit
+	UploadThrottle   *Throttle
+	DownloadThrottle *Throttle
+	// Where the client logs, the default logger if nil
+	Log *Logger
+	// How calls that failed transiently are retried, never if nil
+	Retry *RetryPolicy
+	// Transfers of the sync in progress, for the next sync to resume; set up by ClientSync
+	Journal *TransferJournal
+	// Told how a sync is getting on, nil for no reports
+	Progress ProgressReporter
+	// Counts for Progress of the sync in progress; set up by ClientSync
+	progress *progressTracker
+	// Inode of each file when it was last scanned or written, for the local
+	// index only; set up by ClientSync
+	inodes map[string]uint64
+}
+
+func (surfClient *RPCClient) logger() *Logger {
+	if surfClient.Log == nil {
+		return DefaultLogger()
+	}
+	return surfClient.Log
+}
+
+// dial connects to a MetaStore or BlockStore with the client's credentials
+func (surfClient *RPCClient) dial(addr string) (*grpc.ClientConn, error) {
+	opts := []grpc.DialOption{
+		grpc.WithInsecure(),
+		grpc.WithUnaryInterceptor(surfClient.logCall),
+		grpc.WithDefaultCallOptions(grpc.MaxCallRecvMsgSize(CLIENT_MAX_MESSAGE_SIZE)),
+	}
+	if surfClient.Credentials != nil {
+		opts[0] = grpc.WithTransportCredentials(surfClient.Credentials)
+	}
+	if surfClient.Token != "" {
+		opts = append(opts, grpc.WithPerRPCCredentials(tokenCredentials{token: surfClient.Token}))
+	}
+	return grpc.Dial(addr, opts...)
+}
+
+// logCall sends every call with a new request id, so it can be found in the
+// server's log, and logs the call with the same id
+func (surfClient *RPCClient) logCall(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	requestID := NewRequestID()
+	ctx = metadata.AppendToOutgoingContext(ctx, REQUEST_ID_METADATA_KEY, requestID)
+	start := time.Now()
+	err := invoker(ctx, method, req, reply, cc, opts...)
+	logger := surfClient.logger().With("request_id", requestID, "method", method, "addr", cc.Target(), "duration", time.Since(start))
+	if err != nil {
+		// The caller decides whether the error matters
+		logger.Debug("call failed", "code", status.Code(err), "error", status.Convert(err).Message())
+	} else {
+		logger.Debug("call done")
+	}
+	return err
+}
+
+// transferOptions compresses a block transfer if the client compresses and the
+// data is worth it. Encrypted blocks never are; downloads are always compressed
+// since the data is not known yet.
+func (surfClient *RPCClient) transferOptions(data []byte) []grpc.CallOption {
+	if !surfClient.Compress || surfClient.Cipher != nil {
+		return nil
+	}
+	if data != nil && len(encodeStoredBlock(data)) > len(data) {
+		return nil
+	}
+	return []grpc.CallOption{grpc.UseCompressor(gzip.Name)}
+}
+
+// isCompressionUnsupported reports whether a server rejected a call for its compression
+func isCompressionUnsupported(err error) bool {
+	return status.Code(err) == codes.Unimplemented && strings.Contains(status.Convert(err).Message(), "grpc-encoding")
 }
 
 func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, block *Block) error {
-	fmt.Println("getBlock started")
+	return surfClient.retry("GetBlock", func() error {
+		return surfClient.getBlock(blockHash, blockStoreAddr, block)
+	})
+}
+
+func (surfClient *RPCClient) getBlock(blockHash string, blockStoreAddr string, block *Block) error {
 	// connect to the server
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
 		return err
 	}
@@ -27,28 +130,55 @@ func (surfClient *RPCClient) GetBlock(blockHash string, blockStoreAddr string, b
 	// perform the call
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	b, err := c.GetBlock(ctx, &BlockHash{Hash: blockHash})
+	b, err := c.GetBlock(ctx, &BlockHash{Hash: blockHash}, surfClient.transferOptions(nil)...)
+	if isCompressionUnsupported(err) {
+		b, err = c.GetBlock(ctx, &BlockHash{Hash: blockHash})
+	}
 	if err != nil {
 		conn.Close()
 		return err
 	}
+	// The block has already arrived, the wait holds back the transfers after it
+	surfClient.DownloadThrottle.Wait(len(b.BlockData))
 	block.BlockData = b.BlockData
 	block.BlockSize = b.BlockSize
+	if surfClient.Cipher != nil {
+		if block.BlockData, err = surfClient.Cipher.OpenBlock(b.BlockData); err != nil {
+			conn.Close()
+			return fmt.Errorf("decrypting block %v: %w", blockHash, err)
+		}
+		block.BlockSize = int32(len(block.BlockData))
+	}
 
 	// close the connection
 	return conn.Close()
 }
 
 func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ *bool) error {
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	return surfClient.retry("PutBlock", func() error {
+		return surfClient.putBlock(block, blockStoreAddr, succ)
+	})
+}
+
+func (surfClient *RPCClient) putBlock(block *Block, blockStoreAddr string, succ *bool) error {
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
 		return err
 	}
 	c := NewBlockStoreClient(conn)
 
+	if surfClient.Cipher != nil {
+		sealed := surfClient.Cipher.SealBlock(block.BlockData)
+		block = &Block{BlockData: sealed, BlockSize: int32(len(sealed))}
+	}
+	surfClient.UploadThrottle.Wait(len(block.BlockData))
+
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
-	success, err := c.PutBlock(ctx, block)
+	success, err := c.PutBlock(ctx, block, surfClient.transferOptions(block.BlockData)...)
+	if isCompressionUnsupported(err) {
+		success, err = c.PutBlock(ctx, block)
+	}
 
 	if err != nil {
 		conn.Close()
@@ -60,8 +190,13 @@ func (surfClient *RPCClient) PutBlock(block *Block, blockStoreAddr string, succ
 }
 
 func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
-	fmt.Println("HasBlocks started")
-	conn, err := grpc.Dial(blockStoreAddr, grpc.WithInsecure())
+	return surfClient.retry("HasBlocks", func() error {
+		return surfClient.hasBlocks(blockHashesIn, blockStoreAddr, blockHashesOut)
+	})
+}
+
+func (surfClient *RPCClient) hasBlocks(blockHashesIn []string, blockStoreAddr string, blockHashesOut *[]string) error {
+	conn, err := surfClient.dial(blockStoreAddr)
 	if err != nil {
 		return err
 	}
@@ -80,8 +215,39 @@ func (surfClient *RPCClient) HasBlocks(blockHashesIn []string, blockStoreAddr st
 }
 
 func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error {
-	fmt.Println("GetFileInfoMap started")
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	return surfClient.retry("GetFileInfoMap", func() error {
+		return surfClient.getFileInfoMap(serverFileInfoMap)
+	})
+}
+
+func (surfClient *RPCClient) getFileInfoMap(serverFileInfoMap *map[string]*FileMetaData) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	fm, err := c.GetFileInfoMap(ctx, &emptypb.Empty{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*serverFileInfoMap = surfClient.decryptFileInfoMap(fm.FileInfoMap)
+
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetFileInfoSnapshot(serverFileInfoMap *map[string]*FileMetaData, snapshotTime *int64, purgeHorizon *int64) error {
+	return surfClient.retry("GetFileInfoMap", func() error {
+		return surfClient.getFileInfoSnapshot(serverFileInfoMap, snapshotTime, purgeHorizon)
+	})
+}
+
+func (surfClient *RPCClient) getFileInfoSnapshot(serverFileInfoMap *map[string]*FileMetaData, snapshotTime *int64, purgeHorizon *int64) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
 	if err != nil {
 		return err
 	}
@@ -95,14 +261,41 @@ func (surfClient *RPCClient) GetFileInfoMap(serverFileInfoMap *map[string]*FileM
 		conn.Close()
 		return err
 	}
-	*serverFileInfoMap = fm.FileInfoMap
+	*serverFileInfoMap = surfClient.decryptFileInfoMap(fm.FileInfoMap)
+	*snapshotTime = fm.SnapshotTime
+	*purgeHorizon = fm.PurgeHorizon
 
 	return conn.Close()
 }
 
+// UpdateFile is not simply retried, an update that failed transiently may
+// still have been applied. Before a retry the file's entry is read back: if it
+// already has the update's version, the update was applied, or another
+// client's was and the update is rejected with -1 like any outdated one.
 func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
-	fmt.Println("UpdateFile started")
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	err := surfClient.updateFile(fileMetaData, latestVersion)
+	for retry := 1; isTransient(err); retry++ {
+		var serverFileInfoMap map[string]*FileMetaData
+		if err := surfClient.GetFileInfoMap(&serverFileInfoMap); err != nil {
+			return err
+		}
+		if stored, ok := serverFileInfoMap[fileMetaData.Filename]; ok && stored.Version >= fileMetaData.Version {
+			*latestVersion = -1
+			if stored.Version == fileMetaData.Version && isSameBlock(stored.BlockHashList, fileMetaData.BlockHashList) {
+				*latestVersion = stored.Version
+			}
+			return nil
+		}
+		if !surfClient.backoff("UpdateFile", retry, err) {
+			break
+		}
+		err = surfClient.updateFile(fileMetaData, latestVersion)
+	}
+	return err
+}
+
+func (surfClient *RPCClient) updateFile(fileMetaData *FileMetaData, latestVersion *int32) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
 	if err != nil {
 		return err
 	}
@@ -111,6 +304,9 @@ func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersio
 	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
 	defer cancel()
 
+	if surfClient.Cipher != nil {
+		fileMetaData = surfClient.Cipher.EncryptMeta(fileMetaData)
+	}
 	uf, err := c.UpdateFile(ctx, fileMetaData)
 	if err != nil {
 		conn.Close()
@@ -121,9 +317,78 @@ func (surfClient *RPCClient) UpdateFile(fileMetaData *FileMetaData, latestVersio
 	return conn.Close()
 }
 
+func (surfClient *RPCClient) RenameFile(oldFilename string, newFilename string, version int32, latestVersion *int32) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if surfClient.Cipher != nil {
+		oldFilename = surfClient.Cipher.EncryptName(oldFilename)
+		newFilename = surfClient.Cipher.EncryptName(newFilename)
+	}
+	v, err := c.RenameFile(ctx, &RenameRequest{OldFilename: oldFilename, NewFilename: newFilename, Version: version})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*latestVersion = v.Version
+
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) CommitFiles(fileMetaDatas []*FileMetaData, committed *bool, conflicts *[]string, renamedVersions *map[string]int32) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	if surfClient.Cipher != nil {
+		sealed := make([]*FileMetaData, len(fileMetaDatas))
+		for i, fileMetaData := range fileMetaDatas {
+			sealed[i] = surfClient.Cipher.EncryptMeta(fileMetaData)
+		}
+		fileMetaDatas = sealed
+	}
+	cr, err := c.CommitFiles(ctx, &FileCommit{Files: fileMetaDatas})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*committed = cr.Committed
+	*conflicts = cr.Conflicts
+	*renamedVersions = make(map[string]int32)
+	for fileName, version := range cr.RenamedVersions {
+		(*renamedVersions)[fileName] = version
+	}
+	if surfClient.Cipher != nil {
+		for i, fileName := range cr.Conflicts {
+			if plain, err := surfClient.Cipher.DecryptName(fileName); err == nil {
+				(*conflicts)[i] = plain
+			}
+		}
+		*renamedVersions = make(map[string]int32)
+		for fileName, version := range cr.RenamedVersions {
+			if plain, err := surfClient.Cipher.DecryptName(fileName); err == nil {
+				fileName = plain
+			}
+			(*renamedVersions)[fileName] = version
+		}
+	}
+
+	return conn.Close()
+}
+
 func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
-	fmt.Println("GetBlockStoreAddr started")
-	conn, err := grpc.Dial(surfClient.MetaStoreAddr, grpc.WithInsecure())
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
 	if err != nil {
 		return err
 	}
@@ -142,6 +407,135 @@ func (surfClient *RPCClient) GetBlockStoreAddr(blockStoreAddr *string) error {
 	return conn.Close()
 }
 
+func (surfClient *RPCClient) AckSync(clientId string, snapshotTime int64, succ *bool) error {
+	conn, err := surfClient.dial(surfClient.MetaStoreAddr)
+	if err != nil {
+		return err
+	}
+	c := NewMetaStoreClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	success, err := c.AckSync(ctx, &SyncAck{ClientId: clientId, SnapshotTime: snapshotTime})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*succ = success.Flag
+
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetServerStats(addr string, stats *ServerStats) error {
+	conn, err := surfClient.dial(addr)
+	if err != nil {
+		return err
+	}
+	c := NewAdminClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	st, err := c.GetServerStats(ctx, &emptypb.Empty{})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	stats.Service = st.Service
+	stats.UptimeSeconds = st.UptimeSeconds
+	stats.Files = st.Files
+	stats.Tombstones = st.Tombstones
+	stats.Namespaces = st.Namespaces
+	stats.Conflicts = st.Conflicts
+	stats.Blocks = st.Blocks
+	stats.RawBytes = st.RawBytes
+	stats.StoredBytes = st.StoredBytes
+	stats.CompressedBlocks = st.CompressedBlocks
+
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) ListFiles(addr string, namespace string, prefix string, includeDeleted bool, files *[]*FileMetaData) error {
+	conn, err := surfClient.dial(addr)
+	if err != nil {
+		return err
+	}
+	c := NewAdminClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	fl, err := c.ListFiles(ctx, &ListFilesRequest{Namespace: namespace, Prefix: prefix, IncludeDeleted: includeDeleted})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*files = fl.Files
+
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) GetFile(addr string, namespace string, fileName string, location *FileLocation) error {
+	conn, err := surfClient.dial(addr)
+	if err != nil {
+		return err
+	}
+	c := NewAdminClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	fl, err := c.GetFile(ctx, &FileRequest{Namespace: namespace, Filename: fileName})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	location.File = fl.File
+	location.BlockStoreAddr = fl.BlockStoreAddr
+
+	return conn.Close()
+}
+
+func (surfClient *RPCClient) FindBlocks(addr string, blockHashesIn []string, blockHashesOut *[]string) error {
+	conn, err := surfClient.dial(addr)
+	if err != nil {
+		return err
+	}
+	c := NewAdminClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	bh, err := c.FindBlocks(ctx, &BlockHashes{Hashes: blockHashesIn})
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	*blockHashesOut = bh.Hashes
+
+	return conn.Close()
+}
+
+// decryptFileInfoMap decrypts the filenames of a file map from the server.
+// Entries that do not decrypt, like the key record, are left out.
+func (surfClient *RPCClient) decryptFileInfoMap(fileInfoMap map[string]*FileMetaData) map[string]*FileMetaData {
+	if surfClient.Cipher == nil {
+		return fileInfoMap
+	}
+	plain := make(map[string]*FileMetaData, len(fileInfoMap))
+	for fileName, metaData := range fileInfoMap {
+		if err := surfClient.Cipher.DecryptMeta(metaData); err != nil {
+			if fileName != ENCRYPTION_KEY_FILENAME {
+				surfClient.logger().Warn("skipping a file that does not decrypt", "filename", fileName, "error", err)
+			}
+			continue
+		}
+		plain[metaData.Filename] = metaData
+	}
+	return plain
+}
+
 // This line guarantees all method for RPCClient are implemented
 var _ ClientInterface = new(RPCClient)
 
@@ -152,5 +546,6 @@ func NewSurfstoreRPCClient(hostPort, baseDir string, blockSize int) RPCClient {
 		MetaStoreAddr: hostPort,
 		BaseDir:       baseDir,
 		BlockSize:     blockSize,
+		Retry:         NewRetryPolicy(DEFAULT_RETRY_BUDGET),
 	}
 }
@@ -0,0 +1,123 @@
+package surfstore
+
+import (
+	context "context"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+)
+
+// RateLimiter limits the calls each client makes to a service with a token
+// bucket: a client may make Burst calls at once and Rate calls per second after
+// that. Clients open a connection for every call, so they are told apart by the
+// remote host of their connections rather than by connection. A rate of zero
+// lets every call through.
+type RateLimiter struct {
+	// Full method prefix of the limited calls, e.g. "/surfstore.BlockStore/"
+	Service string
+	// Use SetLimits to change them while serving
+	Rate    float64
+	Burst   int
+	buckets map[string]*tokenBucket
+	swept   time.Time
+	mtx     sync.Mutex
+}
+
+type tokenBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func NewRateLimiter(service string, rate float64, burst int) *RateLimiter {
+	return &RateLimiter{
+		Service: service,
+		Rate:    rate,
+		Burst:   burst,
+		buckets: make(map[string]*tokenBucket),
+		swept:   time.Now(),
+	}
+}
+
+// SetLimits changes the rate and the burst. Every client starts over with a full bucket.
+func (r *RateLimiter) SetLimits(rate float64, burst int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	r.Rate = rate
+	r.Burst = burst
+	r.buckets = make(map[string]*tokenBucket)
+}
+
+// Limits returns the rate and the burst
+func (r *RateLimiter) Limits() (float64, int) {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	return r.Rate, r.Burst
+}
+
+// Allow takes a token from a client's bucket, if there is one left
+func (r *RateLimiter) Allow(client string) bool {
+	r.mtx.Lock()
+	defer r.mtx.Unlock()
+	if r.Rate <= 0 {
+		return true
+	}
+	now := time.Now()
+	r.sweep(now)
+
+	bucket, ok := r.buckets[client]
+	if !ok {
+		bucket = &tokenBucket{tokens: float64(r.Burst), last: now}
+		r.buckets[client] = bucket
+	}
+	bucket.tokens += now.Sub(bucket.last).Seconds() * r.Rate
+	if bucket.tokens > float64(r.Burst) {
+		bucket.tokens = float64(r.Burst)
+	}
+	bucket.last = now
+	if bucket.tokens < 1 {
+		return false
+	}
+	bucket.tokens -= 1
+	return true
+}
+
+// sweep forgets the buckets that have filled up again, which are the same as
+// new ones, so clients that went away do not pile up. It runs at most once a minute.
+func (r *RateLimiter) sweep(now time.Time) {
+	if now.Sub(r.swept) < time.Minute {
+		return
+	}
+	r.swept = now
+	refill := time.Duration(float64(r.Burst) / r.Rate * float64(time.Second))
+	for client, bucket := range r.buckets {
+		if now.Sub(bucket.last) >= refill {
+			delete(r.buckets, client)
+		}
+	}
+}
+
+// UnaryInterceptor rejects calls to the limited service over a client's rate
+// with ResourceExhausted
+func (r *RateLimiter) UnaryInterceptor(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	if !strings.HasPrefix(info.FullMethod, r.Service) {
+		return handler(ctx, req)
+	}
+	client := ""
+	if p, ok := peer.FromContext(ctx); ok {
+		client = p.Addr.String()
+		if host, _, err := net.SplitHostPort(client); err == nil {
+			client = host
+		}
+	}
+	if !r.Allow(client) {
+		rate, _ := r.Limits()
+		return nil, status.Errorf(codes.ResourceExhausted, "rate limit of %v requests per second exceeded", rate)
+	}
+	return handler(ctx, req)
+}
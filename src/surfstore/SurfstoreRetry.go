@@ -0,0 +1,84 @@
+package surfstore
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// RetryPolicy says how calls that failed for a transient reason are retried:
+// up to MaxAttempts times each, waiting an exponentially growing, jittered
+// delay in between, and no more often in total than the budget allows, so a
+// server that is down does not stall a sync for long.
+type RetryPolicy struct {
+	// Attempts per call, including the first
+	MaxAttempts int
+	// Delay before the first retry, doubled for every further one up to MaxDelay
+	BaseDelay time.Duration
+	MaxDelay  time.Duration
+	// Retries left for every call made with the policy
+	budget int
+	mtx    sync.Mutex
+}
+
+// NewRetryPolicy returns the default policy with a budget of retries
+func NewRetryPolicy(budget int) *RetryPolicy {
+	return &RetryPolicy{
+		MaxAttempts: DEFAULT_RETRY_ATTEMPTS,
+		BaseDelay:   100 * time.Millisecond,
+		MaxDelay:    2 * time.Second,
+		budget:      budget,
+	}
+}
+
+// take uses up one retry of the budget, if any is left
+func (p *RetryPolicy) take() bool {
+	p.mtx.Lock()
+	defer p.mtx.Unlock()
+	if p.budget <= 0 {
+		return false
+	}
+	p.budget -= 1
+	return true
+}
+
+// delay returns how long to wait before an attempt, counted from the first retry.
+// Half of it is random so clients that failed together do not retry together.
+func (p *RetryPolicy) delay(retry int) time.Duration {
+	delay := p.MaxDelay
+	if retry < 32 && p.BaseDelay<<(retry-1) < p.MaxDelay {
+		delay = p.BaseDelay << (retry - 1)
+	}
+	return delay/2 + time.Duration(rand.Int63n(int64(delay/2)+1))
+}
+
+// isTransient reports whether a call failed in a way that may go away by itself
+func isTransient(err error) bool {
+	code := status.Code(err)
+	return code == codes.Unavailable || code == codes.DeadlineExceeded
+}
+
+// backoff decides whether a call that failed transiently is retried and waits
+// before the retry if it is. A client without a retry policy never retries.
+func (surfClient *RPCClient) backoff(method string, retry int, err error) bool {
+	policy := surfClient.Retry
+	if policy == nil || retry >= policy.MaxAttempts || !policy.take() {
+		return false
+	}
+	delay := policy.delay(retry)
+	surfClient.logger().Info("retrying call", "method", method, "retry", retry, "delay", delay, "error", status.Convert(err).Message())
+	time.Sleep(delay)
+	return true
+}
+
+// retry makes an idempotent call, again while it fails transiently and the policy allows
+func (surfClient *RPCClient) retry(method string, call func() error) error {
+	err := call()
+	for retry := 1; isTransient(err) && surfClient.backoff(method, retry, err); retry++ {
+		err = call()
+	}
+	return err
+}
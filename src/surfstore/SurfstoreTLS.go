@@ -0,0 +1,113 @@
+package surfstore
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io/ioutil"
+
+	"google.golang.org/grpc/credentials"
+)
+
+// TLSConfig holds the certificate paths of a server or a client.
+// Leaving every path empty keeps the connection in plain text.
+type TLSConfig struct {
+	CertFile string `yaml:"cert"`
+	KeyFile  string `yaml:"key"`
+	// CA bundle that the peer's certificate must chain to
+	CAFile string `yaml:"ca"`
+	// Server only: reject clients without a certificate signed by CAFile
+	RequireClientCert bool `yaml:"clientAuth"`
+	// Client only: verify the server certificate against this name instead of the dialed host
+	ServerName string `yaml:"serverName"`
+}
+
+// Enabled reports whether any TLS setting was given
+func (c *TLSConfig) Enabled() bool {
+	return c != nil && (c.CertFile != "" || c.KeyFile != "" || c.CAFile != "")
+}
+
+// NewServerCredentials builds the transport credentials for a gRPC server.
+// It returns nil if TLS is not enabled.
+func NewServerCredentials(c *TLSConfig) (credentials.TransportCredentials, error) {
+	if !c.Enabled() {
+		if c != nil && c.RequireClientCert {
+			return nil, fmt.Errorf("client certificate verification needs a server certificate, key and CA")
+		}
+		return nil, nil
+	}
+	if c.CertFile == "" || c.KeyFile == "" {
+		return nil, fmt.Errorf("a TLS server needs both a certificate and a key")
+	}
+	cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading server certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+
+	if c.RequireClientCert {
+		if c.CAFile == "" {
+			return nil, fmt.Errorf("client certificate verification needs a CA file")
+		}
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	} else if c.CAFile != "" {
+		// Client certificates are optional, but checked when presented
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.VerifyClientCertIfGiven
+	}
+	return credentials.NewTLS(config), nil
+}
+
+// NewClientCredentials builds the transport credentials for dialing a server.
+// It returns nil if TLS is not enabled. Without a CA file the system roots are trusted.
+func NewClientCredentials(c *TLSConfig) (credentials.TransportCredentials, error) {
+	if !c.Enabled() {
+		return nil, nil
+	}
+	config := &tls.Config{
+		ServerName: c.ServerName,
+		MinVersion: tls.VersionTLS12,
+	}
+	if c.CAFile != "" {
+		pool, err := loadCertPool(c.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = pool
+	}
+	if c.CertFile != "" || c.KeyFile != "" {
+		if c.CertFile == "" || c.KeyFile == "" {
+			return nil, fmt.Errorf("a client certificate needs both a certificate and a key")
+		}
+		cert, err := tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("loading client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return credentials.NewTLS(config), nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, fmt.Errorf("loading CA file: %w", err)
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("no certificates found in CA file %v", caFile)
+	}
+	return pool, nil
+}
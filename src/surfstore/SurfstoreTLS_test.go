@@ -0,0 +1,158 @@
+package surfstore
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"testing"
+	"time"
+
+	grpc "google.golang.org/grpc"
+)
+
+// testPKI is a CA and the certificates it signed for a test, as files
+type testPKI struct {
+	dir              string
+	caCert           *x509.Certificate
+	caKey            *ecdsa.PrivateKey
+	CAFile           string
+	ServerCertFile   string
+	ServerKeyFile    string
+	ClientCertFile   string
+	ClientKeyFile    string
+	nextSerialNumber int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	pki := &testPKI{dir: t.TempDir(), nextSerialNumber: 1}
+	caTemplate := &x509.Certificate{
+		Subject:               pkix.Name{CommonName: "surfstore test CA"},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	pki.caCert, pki.caKey, pki.CAFile, _ = pki.issue(t, "ca", caTemplate)
+	pki.ServerCertFile, pki.ServerKeyFile = pki.issueLeaf(t, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "localhost"},
+		DNSNames:    []string{"localhost"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	pki.ClientCertFile, pki.ClientKeyFile = pki.issueLeaf(t, "client", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "client"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	return pki
+}
+
+func (pki *testPKI) issueLeaf(t *testing.T, name string, template *x509.Certificate) (string, string) {
+	template.KeyUsage = x509.KeyUsageDigitalSignature
+	_, _, certFile, keyFile := pki.issue(t, name, template)
+	return certFile, keyFile
+}
+
+// issue creates a key and a certificate for it, signed by the CA or by itself
+// if there is no CA yet, and writes both as PEM files
+func (pki *testPKI) issue(t *testing.T, name string, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey, string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template.SerialNumber = big.NewInt(pki.nextSerialNumber)
+	pki.nextSerialNumber += 1
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+	parent, parentKey := pki.caCert, pki.caKey
+	if parent == nil {
+		parent, parentKey = template, key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, err := x509.ParseCertificate(der)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certFile, keyFile := ConcatPath(pki.dir, name+".pem"), ConcatPath(pki.dir, name+"-key.pem")
+	if err := ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return cert, key, certFile, keyFile
+}
+
+// startTLSServer serves a MetaStore with the given TLS settings until the test ends
+func startTLSServer(t *testing.T, config *TLSConfig) string {
+	creds, err := NewServerCredentials(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	grpcServer := grpc.NewServer(grpc.Creds(creds))
+	RegisterMetaStoreServer(grpcServer, NewMetaStore(listener.Addr().String()))
+	go grpcServer.Serve(listener)
+	t.Cleanup(grpcServer.Stop)
+	return listener.Addr().String()
+}
+
+// callMetaStore makes one MetaStore call with the given client TLS settings,
+// nil for plain text, and without retries
+func callMetaStore(t *testing.T, addr string, config *TLSConfig) error {
+	client := NewSurfstoreRPCClient(addr, t.TempDir(), 4096)
+	client.Retry = nil
+	if config != nil {
+		creds, err := NewClientCredentials(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		client.Credentials = creds
+	}
+	var blockStoreAddr string
+	return client.GetBlockStoreAddr(&blockStoreAddr)
+}
+
+func TestTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startTLSServer(t, &TLSConfig{CertFile: pki.ServerCertFile, KeyFile: pki.ServerKeyFile})
+
+	if err := callMetaStore(t, addr, &TLSConfig{CAFile: pki.CAFile}); err != nil {
+		t.Errorf("TLS client: %v", err)
+	}
+	if err := callMetaStore(t, addr, nil); err == nil {
+		t.Error("plain text client connected to a TLS server")
+	}
+}
+
+func TestMutualTLS(t *testing.T) {
+	pki := newTestPKI(t)
+	addr := startTLSServer(t, &TLSConfig{
+		CertFile:          pki.ServerCertFile,
+		KeyFile:           pki.ServerKeyFile,
+		CAFile:            pki.CAFile,
+		RequireClientCert: true,
+	})
+
+	withCert := &TLSConfig{CAFile: pki.CAFile, CertFile: pki.ClientCertFile, KeyFile: pki.ClientKeyFile}
+	if err := callMetaStore(t, addr, withCert); err != nil {
+		t.Errorf("client with a certificate: %v", err)
+	}
+	if err := callMetaStore(t, addr, &TLSConfig{CAFile: pki.CAFile}); err == nil {
+		t.Error("client without a certificate was accepted")
+	}
+}
@@ -0,0 +1,96 @@
+package surfstore
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Throttle limits the bytes per second of the transfers that share it. Each
+// transfer reserves the time its bytes take at the rate, one after the other,
+// and waits until its turn comes. Idle time is not saved up for later bursts.
+type Throttle struct {
+	// Bytes per second, zero for no limit
+	rate int64
+	// When the bytes reserved so far have been transferred at the rate
+	next time.Time
+	mtx  sync.Mutex
+}
+
+func NewThrottle(bytesPerSecond int64) *Throttle {
+	return &Throttle{rate: bytesPerSecond}
+}
+
+// SetRate changes the rate, zero for no limit. Transfers already waiting keep their turn.
+func (t *Throttle) SetRate(bytesPerSecond int64) {
+	t.mtx.Lock()
+	defer t.mtx.Unlock()
+	t.rate = bytesPerSecond
+	if bytesPerSecond <= 0 {
+		t.next = time.Time{}
+	}
+}
+
+// Wait reserves n bytes and sleeps until the bytes reserved before them have
+// been transferred at the rate. A nil throttle never waits.
+func (t *Throttle) Wait(n int) {
+	if t == nil {
+		return
+	}
+	t.mtx.Lock()
+	if t.rate <= 0 {
+		t.mtx.Unlock()
+		return
+	}
+	now := time.Now()
+	start := t.next
+	if start.Before(now) {
+		start = now
+	}
+	t.next = start.Add(time.Duration(float64(n) / float64(t.rate) * float64(time.Second)))
+	t.mtx.Unlock()
+
+	time.Sleep(start.Sub(now))
+}
+
+// TransferLimits are a client's block bytes per second in each direction, zero for no limit
+type TransferLimits struct {
+	Upload   int64
+	Download int64
+}
+
+// LoadTransferLimits loads a limits file, one <direction>,<bytes> line for
+// upload and for download. A direction without a line has no limit.
+func LoadTransferLimits(path string) (TransferLimits, error) {
+	var limits TransferLimits
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return limits, err
+	}
+	for i, line := range strings.Split(string(content), "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		items := strings.Split(line, CONFIG_DELIMITER)
+		if len(items) != 2 {
+			return limits, fmt.Errorf("%v line %v: expected <upload|download>,<bytes>", path, i+1)
+		}
+		rate, err := strconv.ParseInt(items[1], 10, 64)
+		if err != nil || rate < 0 {
+			return limits, fmt.Errorf("%v line %v: the rate must be a number of bytes, 0 for no limit", path, i+1)
+		}
+		switch items[0] {
+		case "upload":
+			limits.Upload = rate
+		case "download":
+			limits.Download = rate
+		default:
+			return limits, fmt.Errorf("%v line %v: unknown direction %v", path, i+1, items[0])
+		}
+	}
+	return limits, nil
+}
@@ -0,0 +1,58 @@
+package surfstore
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestLoadTransferLimits(t *testing.T) {
+	for _, test := range []struct {
+		name    string
+		content string
+		want    TransferLimits
+		wantErr bool
+	}{
+		{name: "both", content: "upload,1000\ndownload,2000\n", want: TransferLimits{Upload: 1000, Download: 2000}},
+		{name: "one direction", content: "# comment\ndownload,2000\n", want: TransferLimits{Download: 2000}},
+		{name: "empty", content: "", want: TransferLimits{}},
+		{name: "unknown direction", content: "sideways,1\n", wantErr: true},
+		{name: "negative rate", content: "upload,-1\n", wantErr: true},
+		{name: "missing rate", content: "upload\n", wantErr: true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "limits.txt")
+			if err := ioutil.WriteFile(path, []byte(test.content), 0644); err != nil {
+				t.Fatal(err)
+			}
+			got, err := LoadTransferLimits(path)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("err = %v, want error %v", err, test.wantErr)
+			}
+			if err == nil && got != test.want {
+				t.Errorf("limits = %+v, want %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestThrottleSetRate(t *testing.T) {
+	throttle := NewThrottle(0)
+	throttle.Wait(1 << 20)
+
+	// 1 KiB at 1 KiB/s delays the next kilobyte by a second
+	throttle.SetRate(1 << 10)
+	throttle.Wait(1 << 10)
+	if wait := time.Until(throttle.next); wait < 900*time.Millisecond {
+		t.Fatalf("next transfer waits %v after limiting the rate, want about a second", wait)
+	}
+
+	// Lifting the limit lets waiting transfers through at once
+	throttle.SetRate(0)
+	start := time.Now()
+	throttle.Wait(1 << 20)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Errorf("Wait took %v without a limit", elapsed)
+	}
+}
@@ -5,6 +5,12 @@ import (
 	"io"
 	"io/ioutil"
 	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/protobuf/proto"
 )
 
 func isSameBlock(a []string, b []string) bool {
@@ -21,150 +27,760 @@ func isSameBlock(a []string, b []string) bool {
 }
 
 // Implement the logic for a client syncing with the server here.
-func ClientSync(client RPCClient) {
+// It returns the outcome of every planned action, and an error if anything
+// failed. Files that failed keep their previous local index entry.
+func ClientSync(client RPCClient) (*SyncResult, error) {
 
 	// When a client syncs its local base directory with the cloud, a number of things must be done to properly complete the sync operation.
 
 	// The client should first scan the base directory, and for each file, compute that file’s hash list. The client should then consult the local index file and compare the results, to see whether (1) there are now new files in the base directory that aren’t in the index file, or (2) files that are in the index file, but have changed since the last time the client was executed (i.e., the hash list is different).
 
-	localIndex, err := LoadMetaFromMetaFile(client.BaseDir)
+	// Every line logged during this sync carries its id
+	client.Log = client.logger().With("sync_id", NewRequestID())
+	client.Log.Debug("sync started", "base_dir", client.BaseDir, "dry_run", client.DryRun)
+	client.progress = newProgressTracker(client.Progress)
+	defer client.progress.finish()
+
+	localIndex, inodes, err := loadIndexFile(client.BaseDir)
 	if err != nil {
-		fmt.Printf("local index loading err %v \n", err)
+		return nil, localError(DEFAULT_META_FILENAME, err)
+	}
+	client.inodes = inodes
+	state, err := LoadClientState(client.BaseDir)
+	if err != nil {
+		return nil, localError(DEFAULT_STATE_FILENAME, err)
+	}
+	if client.Passphrase != "" {
+		if err := setupEncryption(&client); err != nil {
+			return nil, err
+		}
 	}
 	remoteIndex := make(map[string]*FileMetaData)
-	client.GetFileInfoMap(&remoteIndex)
+	var snapshotTime, purgeHorizon int64
+	if err := client.GetFileInfoSnapshot(&remoteIndex, &snapshotTime, &purgeHorizon); err != nil {
+		return nil, networkError("", err)
+	}
+	if _, ok := remoteIndex[ENCRYPTION_KEY_FILENAME]; ok {
+		// Without the passphrase the files would be downloaded as ciphertext under encrypted names
+		return nil, &SyncError{Kind: ERR_AUTH, Err: fmt.Errorf("the server's files are encrypted, a passphrase is required")}
+	}
+	// The server purged tombstones this client never saw, so the local index
+	// cannot tell a remote deletion from a file the server has never had.
+	fullReconcile := state.LastSync < purgeHorizon
 
-	files, err := ioutil.ReadDir(client.BaseDir)
+	// Paths outside the sync rules are neither uploaded, downloaded nor deleted,
+	// and their index entries are kept aside untouched until the end
+	rules, err := LoadSyncRules(client.BaseDir)
 	if err != nil {
-		fmt.Printf("base dir file load err %v \n", err)
+		return nil, localError(DEFAULT_RULES_FILENAME, err)
+	}
+	skippedIndex := make(map[string]*FileMetaData)
+	for fileName, localdata := range localIndex {
+		if !rules.Matches(fileName) {
+			skippedIndex[fileName] = localdata
+			delete(localIndex, fileName)
+		}
+	}
+	for fileName := range remoteIndex {
+		if !rules.Matches(fileName) {
+			delete(remoteIndex, fileName)
+		}
+	}
+
+	files, err := listFiles(client.BaseDir, rules, client.Log)
+	if err != nil {
+		return nil, localError("", err)
+	}
+
+	// Entries as they were before this sync, restored for files that fail
+	prevIndex := make(map[string]*FileMetaData, len(localIndex))
+	for fileName, localdata := range localIndex {
+		prevIndex[fileName] = proto.Clone(localdata).(*FileMetaData)
 	}
+	result := &SyncResult{Files: make([]FileResult, 0)}
 
 	currFiles := make(map[string][]string)
+	changedFiles := make(map[string]bool)
+	newFiles := make(map[string]bool)
 
-	for _, file := range files {
-		fileName := file.Name()
-		fmt.Println(fileName)
-		if fileName == DEFAULT_META_FILENAME || fileName == ".DS_Store" {
+	client.progress.startScan(len(files))
+	for fileName, file := range files {
+		client.progress.fileScanned()
+		// Symlinks are synced as links, their content is the target path
+		fileType := FileType_REGULAR
+		if file.Mode()&os.ModeSymlink != 0 {
+			fileType = FileType_SYMLINK
+		} else if !file.Mode().IsRegular() {
 			continue
 		}
-		currFile, err := os.Open(ConcatPath(client.BaseDir, fileName))
-		if err != nil {
-			fmt.Printf("open current file err %v \n", err)
-		}
-		for {
-			buf := make([]byte, client.BlockSize)
-			l, err := currFile.Read(buf)
-			if err == io.EOF {
-				break
-			} else if err != nil {
-				fmt.Printf("read err %v \n", err)
-				break
+		prev, isUsed := localIndex[fileName]
+		if isUsed && !client.Rehash && isUnchanged(prev, inodes[fileName], file, fileType) {
+			currFiles[fileName] = prev.BlockHashList
+		} else {
+			hashList, err := hashContent(ConcatPath(client.BaseDir, fileName), fileType, client.BlockSize, client.Cipher)
+			if err != nil {
+				// Left out of this sync entirely rather than taken for a deletion
+				client.Log.Warn("cannot hash file", "filename", fileName, "error", err)
+				result.record(SyncAction{Action: ACTION_UPLOAD, Filename: fileName}, localError(fileName, err))
+				if prev, ok := localIndex[fileName]; ok {
+					skippedIndex[fileName] = prev
+					delete(localIndex, fileName)
+				}
+				delete(remoteIndex, fileName)
+				continue
 			}
-			buf = buf[:l]
-			hashString := GetBlockHashString(buf)
-			currFiles[fileName] = append(currFiles[fileName], hashString)
+			currFiles[fileName] = hashList
 		}
-		prev, isUsed := localIndex[fileName]
 
 		// fmt.Println("prev : ", localIndex[fileName].BlockHashList)
 		// fmt.Println("curr : ", currFiles[fileName])
 		if isUsed {
-			if !isSameBlock(prev.BlockHashList, currFiles[fileName]) {
+			// Entries from index files without attributes have no mode to compare
+			modeChanged := prev.Mode != 0 && (prev.Mode != uint32(file.Mode().Perm()) || prev.FileType != fileType)
+			if !isSameBlock(prev.BlockHashList, currFiles[fileName]) || modeChanged {
 				localIndex[fileName].BlockHashList = currFiles[fileName]
 				localIndex[fileName].Version += 1
+				localIndex[fileName].DeletedAt = 0
+				changedFiles[fileName] = true
 			}
 		} else {
 			newMetaFile := FileMetaData{Filename: fileName, Version: 1, BlockHashList: currFiles[fileName]}
 			localIndex[fileName] = &newMetaFile
+			changedFiles[fileName] = true
+			newFiles[fileName] = true
+		}
+		setFileAttributes(localIndex[fileName], file, fileType)
+		inodes[fileName] = fileInode(file)
+	}
+
+	// Renames are detected before deletions are marked, while the old entry still has its version
+	renames := make([]SyncAction, 0)
+	if !fullReconcile {
+		for oldName, newName := range detectRenames(localIndex, currFiles, newFiles) {
+			renames = append(renames, SyncAction{
+				Action:      ACTION_RENAME_REMOTE,
+				Filename:    oldName,
+				NewFilename: newName,
+				Version:     localIndex[oldName].Version,
+			})
 		}
 	}
 
 	for fileName, localdata := range localIndex {
 		if _, ok := currFiles[fileName]; !ok {
-			if !isDeleted(localdata.BlockHashList) {
+			if !IsDeleted(localdata.BlockHashList) {
 				localdata.Version += 1
 				localdata.BlockHashList = []string{"0"}
+				localdata.DeletedAt = time.Now().UnixNano()
+				changedFiles[fileName] = true
 			}
 		}
 	}
 
-	for fileName, remotedata := range remoteIndex {
-		localdata, isUsed := localIndex[fileName]
-		if isUsed {
-			if remotedata.Version > localdata.Version {
-				download(client, remotedata, localdata)
-			} else {
-				if localdata.Version == remotedata.Version {
-					if !isSameBlock(localdata.BlockHashList, remotedata.BlockHashList) {
-						download(client, remotedata, localdata)
-					}
-				}
+	plan := planSync(localIndex, remoteIndex, currFiles, changedFiles, renames, fullReconcile)
+	result.Plan = plan
+	if client.DryRun {
+		if err := PrintSyncPlan(os.Stdout, plan, client.PlanJSON); err != nil {
+			return result, localError("", err)
+		}
+		return result, result.Err
+	}
+	// Transfers an interrupted sync left resume, those of files this sync does not transfer are dropped
+	journal, err := LoadTransferJournal(client.BaseDir)
+	if err != nil {
+		return result, localError(DEFAULT_JOURNAL_FILENAME, err)
+	}
+	planned := make(map[string]bool)
+	for _, action := range plan.Actions {
+		planned[action.Filename] = true
+		planned[action.NewFilename] = true
+	}
+	journal.Prune(planned)
+	client.Journal = journal
+	for _, action := range plan.Actions {
+		blocks := 0
+		switch action.Action {
+		case ACTION_UPLOAD:
+			blocks = transferBlocks(localIndex[action.Filename])
+		case ACTION_DOWNLOAD:
+			blocks = transferBlocks(remoteIndex[action.Filename])
+		}
+		client.progress.addPlanned(1, blocks, action.Bytes)
+	}
+	client.progress.startTransfer()
+	executeSync(client, plan, localIndex, remoteIndex, prevIndex, result)
+	// Failures are the caller's to report, they are only logged for the record
+	for _, file := range result.Files {
+		logger := client.Log.With("action", file.Action, "filename", file.Filename, "outcome", file.Outcome)
+		if file.Err != nil {
+			logger = logger.With("error", file.Err)
+		}
+		logger.Info("action finished")
+	}
+
+	// Only a sync that applied every remote change may claim to have seen the snapshot
+	if result.appliedRemote() {
+		var acked bool
+		if err := client.AckSync(state.ClientId, snapshotTime, &acked); err != nil {
+			result.Err = moreSevere(result.Err, networkError("", err))
+		} else {
+			state.LastSync = snapshotTime
+			if err := WriteClientState(state, client.BaseDir); err != nil {
+				result.Err = moreSevere(result.Err, localError(DEFAULT_STATE_FILENAME, err))
 			}
+		}
+	}
+
+	if client.Log.Enabled(LOG_DEBUG) {
+		logMetaMap(client.Log.With("index", "local"), localIndex)
+		// Fetched again only to show what the sync left on the server
+		if err := client.GetFileInfoMap(&remoteIndex); err != nil {
+			client.Log.Debug("cannot fetch the remote index", "error", err)
 		} else {
-			localIndex[fileName] = &FileMetaData{}
-			download(client, remotedata, localIndex[fileName])
+			logMetaMap(client.Log.With("index", "remote"), remoteIndex)
 		}
 	}
 
-	for fileName, localdata := range localIndex {
-		remotedata, isUsed := remoteIndex[fileName]
-		if isUsed {
-			if remotedata.Version < localdata.Version {
-				upload(client, localdata)
+	for fileName, localdata := range skippedIndex {
+		localIndex[fileName] = localdata
+	}
+	if err := writeIndexFile(localIndex, client.inodes, client.BaseDir); err != nil {
+		result.Err = moreSevere(result.Err, localError(DEFAULT_META_FILENAME, err))
+	}
+	return result, result.Err
+}
+
+// executeSync carries out a sync plan against the base directory and the
+// server, recording the outcome of every action. Files whose action fails get
+// their previous index entry back, so the next sync tries them again.
+func executeSync(client RPCClient, plan *SyncPlan, localIndex map[string]*FileMetaData, remoteIndex map[string]*FileMetaData, prevIndex map[string]*FileMetaData, result *SyncResult) {
+	record := func(action SyncAction, err error) {
+		result.record(action, err)
+		client.progress.actionDone()
+	}
+	pending := make([]SyncAction, 0)
+	for _, action := range plan.Actions {
+		fileName := action.Filename
+		switch action.Action {
+		case ACTION_DELETE_LOCAL:
+			if remotedata, ok := remoteIndex[fileName]; ok {
+				record(action, downloadAction(client, action, remotedata, localIndex, prevIndex))
+			} else if err := checkParents(client.BaseDir, fileName); err != nil {
+				record(action, localError(fileName, err))
+			} else if err := os.Remove(ConcatPath(client.BaseDir, fileName)); err != nil && !os.IsNotExist(err) {
+				// Unchanged since the last sync and gone from the server: its tombstone was purged
+				record(action, localError(fileName, err))
+			} else {
+				removeEmptyParents(client.BaseDir, fileName)
+				record(action, nil)
+			}
+		case ACTION_RENAME_REMOTE:
+			if client.Atomic {
+				// Committed with the other changes as the old name's tombstone, which the server resolves to the rename
+				localIndex[fileName].RenamedTo = action.NewFilename
+				pending = append(pending, action)
+			} else if renameRemote(client, localIndex, action) {
+				record(action, nil)
+			} else {
+				// Uploading the file again is one more action than planned
+				client.progress.addPlanned(1, transferBlocks(localIndex[action.NewFilename]), localIndex[action.NewFilename].Size)
+				pending = append(pending,
+					SyncAction{Action: ACTION_DELETE_REMOTE, Filename: fileName, Version: localIndex[fileName].Version},
+					SyncAction{Action: ACTION_UPLOAD, Filename: action.NewFilename, Version: localIndex[action.NewFilename].Version, Bytes: localIndex[action.NewFilename].Size})
+			}
+		case ACTION_RENAME_LOCAL:
+			if renameLocal(client, localIndex, remoteIndex, action) {
+				record(action, nil)
+			} else {
+				deleteOld := SyncAction{Action: ACTION_DELETE_LOCAL, Filename: fileName, Version: remoteIndex[fileName].Version}
+				record(deleteOld, downloadAction(client, deleteOld, remoteIndex[fileName], localIndex, prevIndex))
+				downloadNew := SyncAction{Action: ACTION_DOWNLOAD, Filename: action.NewFilename, Version: action.Version, Bytes: remoteIndex[action.NewFilename].Size}
+				client.progress.addPlanned(1, transferBlocks(remoteIndex[action.NewFilename]), downloadNew.Bytes)
+				record(downloadNew, downloadAction(client, downloadNew, remoteIndex[action.NewFilename], localIndex, prevIndex))
+			}
+		case ACTION_DOWNLOAD:
+			record(action, downloadAction(client, action, remoteIndex[fileName], localIndex, prevIndex))
+		case ACTION_UPLOAD, ACTION_DELETE_REMOTE:
+			pending = append(pending, action)
+		}
+	}
+
+	// Without a transaction, renames were already committed on their own by RenameFile
+	errs := make(map[string]error)
+	if client.Atomic {
+		metaDatas := make([]*FileMetaData, 0, len(pending))
+		for _, action := range pending {
+			metaDatas = append(metaDatas, localIndex[action.Filename])
+		}
+		var renamedVersions map[string]int32
+		errs, renamedVersions = commitAll(client, metaDatas)
+		for _, action := range pending {
+			if version, ok := renamedVersions[action.NewFilename]; ok && action.Action == ACTION_RENAME_REMOTE {
+				localIndex[action.NewFilename].Version = version
+			}
+			client.progress.actionDone()
+		}
+	} else {
+		for _, action := range pending {
+			errs[action.Filename] = upload(client, localIndex[action.Filename])
+			client.progress.actionDone()
+		}
+	}
+	for _, action := range pending {
+		err := errs[action.Filename]
+		if err != nil {
+			restoreEntry(localIndex, prevIndex, action.Filename)
+			if action.Action == ACTION_RENAME_REMOTE {
+				restoreEntry(localIndex, prevIndex, action.NewFilename)
 			}
-		} else {
-			upload(client, localdata)
 		}
+		result.record(action, err)
 	}
+}
+
+// downloadAction downloads a file, or deletes it for a tombstone, and reports
+// a conflict if that replaced local changes
+func downloadAction(client RPCClient, action SyncAction, remotedata *FileMetaData, localIndex map[string]*FileMetaData, prevIndex map[string]*FileMetaData) error {
+	if _, ok := localIndex[action.Filename]; !ok {
+		localIndex[action.Filename] = &FileMetaData{}
+	}
+	if err := download(client, remotedata, localIndex[action.Filename]); err != nil {
+		restoreEntry(localIndex, prevIndex, action.Filename)
+		return err
+	}
+	if action.Conflict {
+		return conflictError(action.Filename, fmt.Sprintf("local changes were replaced by version %v", action.Version))
+	}
+	return nil
+}
+
+// restoreEntry puts back a file's local index entry from before the sync
+func restoreEntry(localIndex map[string]*FileMetaData, prevIndex map[string]*FileMetaData, fileName string) {
+	if prev, ok := prevIndex[fileName]; ok {
+		localIndex[fileName] = prev
+	} else {
+		delete(localIndex, fileName)
+	}
+}
+
+// setupEncryption derives the client's cipher from its passphrase and the salt
+// kept on the server, creating the salt on the first encrypted sync
+func setupEncryption(client *RPCClient) error {
+	remoteIndex := make(map[string]*FileMetaData)
+	if err := client.GetFileInfoMap(&remoteIndex); err != nil {
+		return networkError("", err)
+	}
+	if record, ok := remoteIndex[ENCRYPTION_KEY_FILENAME]; ok {
+		salt, check, err := ParseKeyRecord(record)
+		if err != nil {
+			return &SyncError{Kind: ERR_AUTH, Err: err}
+		}
+		cipher, err := NewCipher(client.Passphrase, salt)
+		if err != nil {
+			return &SyncError{Kind: ERR_AUTH, Err: err}
+		}
+		if !cipher.Matches(check) {
+			return &SyncError{Kind: ERR_AUTH, Err: fmt.Errorf("wrong passphrase for the server's files")}
+		}
+		client.Cipher = cipher
+		return nil
+	}
+
+	if len(remoteIndex) > 0 {
+		return &SyncError{Kind: ERR_AUTH, Err: fmt.Errorf("the server already has unencrypted files, encryption must be used from the first sync")}
+	}
+	salt, err := NewSalt()
+	if err != nil {
+		return localError("", err)
+	}
+	cipher, err := NewCipher(client.Passphrase, salt)
+	if err != nil {
+		return &SyncError{Kind: ERR_AUTH, Err: err}
+	}
+	if !client.DryRun {
+		var version int32
+		if err := client.UpdateFile(cipher.KeyRecord(salt), &version); err != nil {
+			return networkError(ENCRYPTION_KEY_FILENAME, err)
+		}
+		if version == -1 {
+			// Another client stored its salt first
+			return setupEncryption(client)
+		}
+	}
+	client.Cipher = cipher
+	return nil
+}
+
+// listFiles walks the base directory and returns every file the sync rules
+// select, keyed by its slash separated path relative to the base directory.
+// Names with a comma or a line break are skipped, the index cannot hold them.
+func listFiles(baseDir string, rules *SyncRules, logger *Logger) (map[string]os.FileInfo, error) {
+	files := make(map[string]os.FileInfo)
+	err := filepath.Walk(baseDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(baseDir, path)
+		if err != nil {
+			return err
+		}
+		fileName := filepath.ToSlash(rel)
+		if strings.ContainsAny(fileName, CONFIG_DELIMITER+"\n\r") {
+			// The server refuses such names and the local index cannot hold them
+			logger.Warn("skipping a file with a comma or a line break in its name", "filename", fileName)
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.IsDir() {
+			if fileName != "." && rules.Excludes(fileName) {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if isReservedFile(fileName) || !rules.Matches(fileName) {
+			return nil
+		}
+		files[fileName] = info
+		return nil
+	})
+	return files, err
+}
+
+// isReservedFile reports whether a path is client bookkeeping rather than synced data
+func isReservedFile(fileName string) bool {
+	switch fileName {
+	case DEFAULT_META_FILENAME, DEFAULT_STATE_FILENAME, DEFAULT_RULES_FILENAME, DEFAULT_JOURNAL_FILENAME:
+		return true
+	}
+	return path.Base(fileName) == ".DS_Store" || strings.HasSuffix(fileName, PARTIAL_SUFFIX)
+}
 
-	client.GetFileInfoMap(&remoteIndex)
+// detectRenames pairs files that disappeared since the last sync with new files
+// that have exactly the same content. Ambiguous and empty contents are not paired.
+func detectRenames(localIndex map[string]*FileMetaData, currFiles map[string][]string, newFiles map[string]bool) map[string]string {
+	disappeared := make(map[string][]string)
+	for fileName, localdata := range localIndex {
+		if _, ok := currFiles[fileName]; !ok && !IsDeleted(localdata.BlockHashList) && len(localdata.BlockHashList) > 0 {
+			key := strings.Join(localdata.BlockHashList, HASH_DELIMITER)
+			disappeared[key] = append(disappeared[key], fileName)
+		}
+	}
+	appeared := make(map[string][]string)
+	for fileName := range newFiles {
+		if hashList := currFiles[fileName]; len(hashList) > 0 {
+			key := strings.Join(hashList, HASH_DELIMITER)
+			appeared[key] = append(appeared[key], fileName)
+		}
+	}
 
-	fmt.Println("#########")
-	fmt.Println("local start")
-	PrintMetaMap(localIndex)
-	fmt.Println("#########")
+	renames := make(map[string]string)
+	for key, oldNames := range disappeared {
+		if newNames := appeared[key]; len(oldNames) == 1 && len(newNames) == 1 {
+			renames[oldNames[0]] = newNames[0]
+		}
+	}
+	return renames
+}
 
-	fmt.Println("#########")
-	fmt.Println("remote start")
-	PrintMetaMap(remoteIndex)
-	fmt.Println("#########")
+// renameRemote records a local rename on the server. If the server rejects it
+// the caller syncs the files as a deletion and a new file instead.
+func renameRemote(client RPCClient, localIndex map[string]*FileMetaData, action SyncAction) bool {
+	var latest int32
+	if err := client.RenameFile(action.Filename, action.NewFilename, action.Version, &latest); err != nil {
+		client.Log.Warn("cannot rename on the server, uploading instead", "filename", action.Filename, "new_filename", action.NewFilename, "error", err)
+		return false
+	}
+	if latest == -1 {
+		client.Log.Info("rename rejected by the server, uploading instead", "filename", action.Filename, "new_filename", action.NewFilename)
+		return false
+	}
 
-	WriteMetaFile(localIndex, client.BaseDir)
+	// The old entry was already marked deleted with the version the server gave its tombstone
+	localIndex[action.NewFilename].Version = latest
+	localIndex[action.Filename].RenamedTo = action.NewFilename
+	return true
+}
 
+// canRenameLocal reports whether a rename made by another client can be applied
+// by moving the local copy: it must be exactly the content that was moved, and
+// nothing may occupy the new name yet.
+func canRenameLocal(localIndex map[string]*FileMetaData, remoteIndex map[string]*FileMetaData, currFiles map[string][]string, oldName string) bool {
+	olddata := localIndex[oldName]
+	remoteOld := remoteIndex[oldName]
+	newName := remoteOld.RenamedTo
+	remoteNew, ok := remoteIndex[newName]
+	if olddata == nil || !ok || IsDeleted(olddata.BlockHashList) || remoteOld.Version <= olddata.Version {
+		return false
+	}
+	_, exists := currFiles[newName]
+	return !exists && isSameBlock(olddata.BlockHashList, remoteNew.BlockHashList)
 }
 
+// renameLocal applies a rename made by another client to the local copy
+func renameLocal(client RPCClient, localIndex map[string]*FileMetaData, remoteIndex map[string]*FileMetaData, action SyncAction) bool {
+	newPath := ConcatPath(client.BaseDir, action.NewFilename)
+	for _, fileName := range []string{action.Filename, action.NewFilename} {
+		if err := checkParents(client.BaseDir, fileName); err != nil {
+			client.Log.Warn("cannot rename locally, downloading instead", "filename", action.Filename, "new_filename", action.NewFilename, "error", err)
+			return false
+		}
+	}
+	if err := os.MkdirAll(filepath.Dir(newPath), 0755); err != nil {
+		client.Log.Warn("cannot rename locally, downloading instead", "filename", action.Filename, "new_filename", action.NewFilename, "error", err)
+		return false
+	}
+	if err := os.Rename(ConcatPath(client.BaseDir, action.Filename), newPath); err != nil {
+		client.Log.Warn("cannot rename locally, downloading instead", "filename", action.Filename, "new_filename", action.NewFilename, "error", err)
+		return false
+	}
+	removeEmptyParents(client.BaseDir, action.Filename)
+	localIndex[action.NewFilename] = proto.Clone(remoteIndex[action.NewFilename]).(*FileMetaData)
+	localIndex[action.Filename] = proto.Clone(remoteIndex[action.Filename]).(*FileMetaData)
+	if info, err := os.Lstat(newPath); err == nil {
+		setFileAttributes(localIndex[action.NewFilename], info, localIndex[action.NewFilename].FileType)
+		client.inodes[action.NewFilename] = fileInode(info)
+	}
+	return true
+}
+
+// checkParents returns an error if a directory of a file below the base
+// directory is a symbolic link. Writing or removing the file would follow it,
+// possibly out of the base directory.
+func checkParents(baseDir string, fileName string) error {
+	for dir := path.Dir(fileName); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		info, err := os.Lstat(ConcatPath(baseDir, dir))
+		if os.IsNotExist(err) {
+			continue
+		} else if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("%v is a symbolic link", dir)
+		}
+	}
+	return nil
+}
+
+// removeEmptyParents removes the directories of a file that are left empty
+// once it is gone, up to but not including the base directory
+func removeEmptyParents(baseDir string, fileName string) {
+	for dir := path.Dir(fileName); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		// Removing a directory that still has entries fails, and so do its parents
+		if err := os.Remove(ConcatPath(baseDir, dir)); err != nil {
+			return
+		}
+	}
+}
+
+// download fetches a file from the server, or removes it for a tombstone.
+// The local metadata is only updated once the file is in place.
 func download(client RPCClient, remoteMeta *FileMetaData, localMeta *FileMetaData) error {
-	URL := ConcatPath(client.BaseDir, remoteMeta.Filename)
-	file, err := os.Create(URL)
-	if err != nil {
-		fmt.Printf("create err %v \n", err)
+	fileName := remoteMeta.Filename
+	URL := ConcatPath(client.BaseDir, fileName)
+	if err := checkParents(client.BaseDir, fileName); err != nil {
+		return localError(fileName, err)
 	}
-	defer file.Close()
+
+	if IsDeleted(remoteMeta.BlockHashList) {
+		if err := os.Remove(URL); err != nil && !os.IsNotExist(err) {
+			return localError(fileName, err)
+		}
+		removeEmptyParents(client.BaseDir, fileName)
+		proto.Reset(localMeta)
+		proto.Merge(localMeta, remoteMeta)
+		return nil
+	}
+
 	var blockAddr string
 	if err := client.GetBlockStoreAddr(&blockAddr); err != nil {
-		fmt.Printf("getting address err %v \n", err)
+		return networkError(fileName, err)
 	}
-	*localMeta = *remoteMeta
-
-	if isDeleted(remoteMeta.BlockHashList) {
-		if err := os.Remove(URL); err != nil {
-			fmt.Printf("remove file error for deleted file %v \n", err)
+	if err := os.MkdirAll(filepath.Dir(URL), 0755); err != nil {
+		return localError(fileName, err)
+	}
+	if remoteMeta.FileType == FileType_SYMLINK {
+		data := make([]byte, 0, remoteMeta.Size)
+		for _, hash := range remoteMeta.BlockHashList {
+			var block Block
+			if err := client.GetBlock(hash, blockAddr, &block); err != nil {
+				return networkError(fileName, err)
+			}
+			data = append(data, block.BlockData...)
+			client.progress.blocksDone(1, int64(len(block.BlockData)), true)
+		}
+		// A link cannot be overwritten in place
+		if err := os.Remove(URL); err != nil && !os.IsNotExist(err) {
+			return localError(fileName, err)
+		}
+		if err := os.Symlink(string(data), URL); err != nil {
+			return localError(fileName, err)
+		}
+	} else {
+		partialPath := partialFilePath(URL)
+		if err := getBlocks(client, remoteMeta, blockAddr, partialPath); err != nil {
 			return err
 		}
-		return nil
+		if err := finishFile(partialPath, URL, remoteMeta, client.Log); err != nil {
+			return localError(fileName, err)
+		}
+		client.Journal.Finish(fileName)
+	}
+
+	proto.Reset(localMeta)
+	proto.Merge(localMeta, remoteMeta)
+	// Cache the local stat so the next scan does not rehash what was just written
+	if info, err := os.Lstat(URL); err == nil {
+		setFileAttributes(localMeta, info, remoteMeta.FileType)
+		client.inodes[fileName] = fileInode(info)
+	}
+	return nil
+}
+
+// getBlocks downloads a file's blocks into its partial file next to the
+// destination, so a failed download never leaves a half written file. Each
+// block is checked against its hash before it is written. A download the
+// journal has from an interrupted sync continues after the blocks it records
+// as written; the partial file is kept when a download fails for the network.
+func getBlocks(client RPCClient, remoteMeta *FileMetaData, blockAddr string, partialPath string) error {
+	fileName := remoteMeta.Filename
+	entry, resumed := client.Journal.Start(ACTION_DOWNLOAD, remoteMeta)
+	file, err := os.OpenFile(partialPath, os.O_WRONLY|os.O_CREATE, 0644)
+	if err != nil {
+		return localError(fileName, err)
+	}
+	defer file.Close()
+	if info, err := file.Stat(); err != nil || info.Size() < entry.Bytes {
+		entry.Blocks, entry.Bytes = 0, 0
+	}
+	if resumed && entry.Blocks > 0 {
+		client.Log.Info("resuming download", "filename", fileName, "blocks", entry.Blocks, "bytes", entry.Bytes)
+		client.progress.blocksDone(entry.Blocks, entry.Bytes, false)
+	}
+	if err := file.Truncate(entry.Bytes); err != nil {
+		return localError(fileName, err)
+	}
+	if _, err := file.Seek(entry.Bytes, io.SeekStart); err != nil {
+		return localError(fileName, err)
+	}
+
+	// A journaled partial file is kept for the next sync to resume, any other
+	// would be left behind for good
+	networkFailure := func(err error) error {
+		if !client.Journal.Tracks(fileName) {
+			file.Close()
+			os.Remove(partialPath)
+		}
+		return networkError(fileName, err)
 	}
-	result := ""
-	for _, hash := range remoteMeta.BlockHashList {
+	for _, hash := range remoteMeta.BlockHashList[entry.Blocks:] {
 		var block Block
 		if err := client.GetBlock(hash, blockAddr, &block); err != nil {
-			fmt.Printf("load block err %v \n", err)
+			return networkFailure(err)
+		}
+		if client.Cipher.BlockHash(block.BlockData) != hash {
+			return networkFailure(fmt.Errorf("block %v does not match its hash", hash))
+		}
+		if _, err := file.Write(block.BlockData); err != nil {
+			file.Close()
+			os.Remove(partialPath)
+			client.Journal.Finish(fileName)
+			return localError(fileName, err)
 		}
-		result += string(block.BlockData)
+		entry.Blocks += 1
+		entry.Bytes += int64(len(block.BlockData))
+		client.Journal.Checkpoint(file)
+		client.progress.blocksDone(1, int64(len(block.BlockData)), true)
+	}
+	if err := file.Close(); err != nil {
+		os.Remove(partialPath)
+		client.Journal.Finish(fileName)
+		return localError(fileName, err)
 	}
-	file.WriteString(result)
 	return nil
 }
 
+// finishFile gives a downloaded partial file the remote metadata and moves it
+// into place. Renaming also replaces a symlink at the destination instead of
+// writing through it.
+func finishFile(partialPath string, URL string, remoteMeta *FileMetaData, logger *Logger) error {
+	if remoteMeta.Mode != 0 {
+		if err := os.Chmod(partialPath, os.FileMode(remoteMeta.Mode)); err != nil {
+			logger.Warn("cannot set file mode", "path", URL, "error", err)
+		}
+	}
+	if remoteMeta.Mtime != 0 {
+		mtime := time.Unix(0, remoteMeta.Mtime)
+		if err := os.Chtimes(partialPath, mtime, mtime); err != nil {
+			logger.Warn("cannot set file mtime", "path", URL, "error", err)
+		}
+	}
+	if err := os.Rename(partialPath, URL); err != nil {
+		os.Remove(partialPath)
+		return err
+	}
+	return nil
+}
+
+// partialFilePath is where a download is written before it is complete
+func partialFilePath(URL string) string {
+	return filepath.Join(filepath.Dir(URL), "."+filepath.Base(URL)+PARTIAL_SUFFIX)
+}
+
+// openContent opens what is synced for a file: its data, or the target of a symlink
+func openContent(path string, fileType FileType) (io.ReadCloser, error) {
+	if fileType == FileType_SYMLINK {
+		target, err := os.Readlink(path)
+		if err != nil {
+			return nil, err
+		}
+		return ioutil.NopCloser(strings.NewReader(target)), nil
+	}
+	return os.Open(path)
+}
+
+// hashContent computes the block hash list of a file, as the block store will
+// see it once the blocks are encrypted with cipher if there is one
+func hashContent(path string, fileType FileType, blockSize int, cipher *Cipher) ([]string, error) {
+	file, err := openContent(path, fileType)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	hashList := make([]string, 0)
+	for {
+		buf := make([]byte, blockSize)
+		l, err := io.ReadFull(file, buf)
+		if err == io.EOF {
+			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return nil, err
+		}
+		hashList = append(hashList, cipher.BlockHash(buf[:l]))
+	}
+	return hashList, nil
+}
+
+// isUnchanged reports whether a file still has the size, mtime and inode
+// recorded in the local index, so its hash list does not need recomputing.
+func isUnchanged(prev *FileMetaData, inode uint64, info os.FileInfo, fileType FileType) bool {
+	return !IsDeleted(prev.BlockHashList) &&
+		prev.FileType == fileType &&
+		prev.Size == info.Size() &&
+		prev.Mtime == info.ModTime().UnixNano() &&
+		inode == fileInode(info)
+}
+
+// setFileAttributes records a scanned file's size, mtime, permissions and type
+func setFileAttributes(metaData *FileMetaData, info os.FileInfo, fileType FileType) {
+	metaData.Size = info.Size()
+	metaData.Mtime = info.ModTime().UnixNano()
+	metaData.Mode = uint32(info.Mode().Perm())
+	metaData.FileType = fileType
+}
+
 func isExistFile(fname string) bool {
 	if _, err := os.Stat(fname); os.IsNotExist(err) {
 		return false
@@ -172,7 +788,16 @@ func isExistFile(fname string) bool {
 	return true
 }
 
-func isDeleted(hash []string) bool {
+// transferBlocks returns how many blocks syncing a file's content transfers
+func transferBlocks(metaData *FileMetaData) int {
+	if metaData == nil || IsDeleted(metaData.BlockHashList) {
+		return 0
+	}
+	return len(metaData.BlockHashList)
+}
+
+// IsDeleted reports whether a block hash list is a tombstone's
+func IsDeleted(hash []string) bool {
 	if len(hash) == 1 {
 		if hash[0] == "0" {
 			return true
@@ -181,43 +806,150 @@ func isDeleted(hash []string) bool {
 	return false
 }
 
+// upload stores a file's blocks and then its metadata on the server
 func upload(client RPCClient, metaData *FileMetaData) error {
-	URL := ConcatPath(client.BaseDir, metaData.Filename)
+	if err := putBlocks(client, metaData); err != nil {
+		return err
+	}
+
 	var latest int32
-	fmt.Println("upload started", URL)
+	if err := client.UpdateFile(metaData, &latest); err != nil {
+		return networkError(metaData.Filename, err)
+	}
+	client.Journal.Finish(metaData.Filename)
+	if latest == -1 {
+		return conflictError(metaData.Filename, "the update was rejected")
+	}
+	metaData.Version = latest
+	return nil
+}
+
+// putBlocks stores every block of a file on the block store. An upload the
+// journal has from an interrupted sync only stores the blocks still missing.
+func putBlocks(client RPCClient, metaData *FileMetaData) error {
+	if IsDeleted(metaData.BlockHashList) {
+		return nil
+	}
+	URL := ConcatPath(client.BaseDir, metaData.Filename)
+	client.Log.Debug("uploading blocks", "filename", metaData.Filename)
 
 	var blockAddr string
 	if err := client.GetBlockStoreAddr(&blockAddr); err != nil {
-		fmt.Printf("getting address err %v \n", err)
+		return networkError(metaData.Filename, err)
 	}
 
-	file, err := os.Open(URL)
+	stored := make(map[string]bool)
+	if _, resumed := client.Journal.Start(ACTION_UPLOAD, metaData); resumed {
+		var err error
+		if stored, err = storedBlocks(client, metaData.BlockHashList, blockAddr); err != nil {
+			return networkError(metaData.Filename, err)
+		}
+		client.Log.Info("resuming upload", "filename", metaData.Filename, "stored_blocks", len(stored))
+	}
+
+	file, err := openContent(URL, metaData.FileType)
 	if err != nil {
-		fmt.Printf("upload(create) err %v \n", err)
+		return localError(metaData.Filename, err)
 	}
 	defer file.Close()
 
-	for {
+	for i := 0; ; i++ {
 		buf := make([]byte, client.BlockSize)
-		l, err := file.Read(buf)
+		l, err := io.ReadFull(file, buf)
 		if err == io.EOF {
+			if i < len(metaData.BlockHashList) {
+				return localError(metaData.Filename, fmt.Errorf("file shrank since it was scanned"))
+			}
 			break
-		} else if err != nil {
-			fmt.Printf("read err %v \n", err)
-			break
+		} else if err != nil && err != io.ErrUnexpectedEOF {
+			return localError(metaData.Filename, err)
 		}
 		buf = buf[:l]
+		// The file may have changed since the scan, committing the hash list would then describe other blocks
+		if i >= len(metaData.BlockHashList) || client.Cipher.BlockHash(buf) != metaData.BlockHashList[i] {
+			return localError(metaData.Filename, fmt.Errorf("file changed since it was scanned"))
+		}
+		if len(stored) > 0 && stored[metaData.BlockHashList[i]] {
+			client.progress.blocksDone(1, int64(l), false)
+			continue
+		}
 		block := Block{BlockData: buf, BlockSize: int32(l)}
 		var success bool
 		if err := client.PutBlock(&block, blockAddr, &success); err != nil {
-			fmt.Printf("putBlock err %v \n", err)
+			return networkError(metaData.Filename, err)
 		}
+		if !success {
+			return networkError(metaData.Filename, fmt.Errorf("block store did not store block %v", GetBlockHashString(buf)))
+		}
+		client.progress.blocksDone(1, int64(l), true)
 	}
+	return nil
+}
 
-	if err := client.UpdateFile(metaData, &latest); err != nil {
-		fmt.Printf("update err %v \n", err)
-		metaData.Version = -1
+// storedBlocks returns which of the blocks the block store already has
+func storedBlocks(client RPCClient, hashes []string, blockAddr string) (map[string]bool, error) {
+	stored := make(map[string]bool)
+	for start := 0; start < len(hashes); start += HAS_BLOCKS_BATCH {
+		end := start + HAS_BLOCKS_BATCH
+		if end > len(hashes) {
+			end = len(hashes)
+		}
+		var found []string
+		if err := client.HasBlocks(hashes[start:end], blockAddr, &found); err != nil {
+			return nil, err
+		}
+		for _, hash := range found {
+			stored[hash] = true
+		}
 	}
-	metaData.Version = latest
-	return nil
+	return stored, nil
+}
+
+// commitAll uploads the blocks of every pending file and then commits all of
+// their metadata in one transaction. If any file fails or conflicts nothing is
+// committed, so every file gets an error. A tombstone with RenamedTo renames
+// the file, and the versions the new names got are returned.
+func commitAll(client RPCClient, pending []*FileMetaData) (map[string]error, map[string]int32) {
+	errs := make(map[string]error)
+	if len(pending) == 0 {
+		return errs, nil
+	}
+	var firstErr error
+	for _, metaData := range pending {
+		if err := putBlocks(client, metaData); err != nil {
+			errs[metaData.Filename] = err
+			firstErr = moreSevere(firstErr, err)
+		}
+	}
+	if firstErr != nil {
+		for _, metaData := range pending {
+			if errs[metaData.Filename] == nil {
+				errs[metaData.Filename] = &SyncError{Kind: ErrorKind(firstErr), Filename: metaData.Filename, Err: fmt.Errorf("not committed, another file of the transaction failed")}
+			}
+		}
+		return errs, nil
+	}
+
+	var committed bool
+	var conflicts []string
+	var renamedVersions map[string]int32
+	if err := client.CommitFiles(pending, &committed, &conflicts, &renamedVersions); err != nil {
+		for _, metaData := range pending {
+			errs[metaData.Filename] = networkError(metaData.Filename, err)
+		}
+		return errs, nil
+	}
+	for _, metaData := range pending {
+		client.Journal.Finish(metaData.Filename)
+	}
+	if !committed {
+		client.Log.Info("commit rejected", "conflicts", conflicts)
+		for _, metaData := range pending {
+			errs[metaData.Filename] = conflictError(metaData.Filename, "not committed, another file of the transaction conflicts")
+		}
+		for _, fileName := range conflicts {
+			errs[fileName] = conflictError(fileName, "the update was rejected")
+		}
+	}
+	return errs, renamedVersions
 }
@@ -0,0 +1,295 @@
+package surfstore
+
+import (
+	"context"
+	"crypto/rand"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+
+	grpc "google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// startTestServer serves a MetaStore and an in-memory BlockStore on a free
+// localhost port until the test ends, and returns their address
+func startTestServer(tb testing.TB) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		tb.Fatal(err)
+	}
+	addr := listener.Addr().String()
+	grpcServer := grpc.NewServer()
+	RegisterMetaStoreServer(grpcServer, NewMetaStore(addr))
+	RegisterBlockStoreServer(grpcServer, NewBlockStore())
+	go grpcServer.Serve(listener)
+	tb.Cleanup(grpcServer.Stop)
+	return addr
+}
+
+func TestPutBlocksRejectsChangedFile(t *testing.T) {
+	const blockSize = 4
+	for _, test := range []struct {
+		name    string
+		changed string
+	}{
+		{"block", "aaaaXbbb"},
+		{"grown", "aaaabbbbcc"},
+		{"shrunk", "aaaa"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			client := NewSurfstoreRPCClient(startTestServer(t), t.TempDir(), blockSize)
+			client.Log = client.logger()
+			path := ConcatPath(client.BaseDir, "f")
+			if err := ioutil.WriteFile(path, []byte("aaaabbbb"), 0644); err != nil {
+				t.Fatal(err)
+			}
+			hashList, err := hashContent(path, FileType_REGULAR, blockSize, nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := ioutil.WriteFile(path, []byte(test.changed), 0644); err != nil {
+				t.Fatal(err)
+			}
+
+			err = putBlocks(client, &FileMetaData{Filename: "f", Version: 1, BlockHashList: hashList})
+			if ErrorKind(err) != ERR_LOCAL_IO {
+				t.Errorf("putBlocks of a file changed to %q: got %v, want a %v error", test.changed, err, ERR_LOCAL_IO)
+			}
+		})
+	}
+}
+
+func TestClientSyncRemovesEmptyDirectories(t *testing.T) {
+	addr := startTestServer(t)
+	a := NewSurfstoreRPCClient(addr, t.TempDir(), 4096)
+	b := NewSurfstoreRPCClient(addr, t.TempDir(), 4096)
+	for fileName, content := range map[string]string{"docs/sub/deleted": "d", "docs/moved/file": "m", "docs/kept": "k"} {
+		if err := os.MkdirAll(filepath.Dir(ConcatPath(a.BaseDir, fileName)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(ConcatPath(a.BaseDir, fileName), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync := func(client RPCClient) {
+		if _, err := ClientSync(client); err != nil {
+			t.Fatal(err)
+		}
+	}
+	sync(a)
+	sync(b)
+
+	if err := os.Remove(ConcatPath(a.BaseDir, "docs/sub/deleted")); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(ConcatPath(a.BaseDir, "docs/moved/file"), ConcatPath(a.BaseDir, "file")); err != nil {
+		t.Fatal(err)
+	}
+	sync(a)
+	result, err := ClientSync(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Plan.Count(ACTION_DELETE_LOCAL) != 1 || result.Plan.Count(ACTION_RENAME_LOCAL) != 1 {
+		t.Fatalf("plan = %+v, want a local deletion and a local rename", result.Plan.Actions)
+	}
+
+	for _, dir := range []string{"docs/sub", "docs/moved"} {
+		if _, err := os.Stat(ConcatPath(b.BaseDir, dir)); !os.IsNotExist(err) {
+			t.Errorf("%v is still there: %v", dir, err)
+		}
+	}
+	if _, err := os.Stat(ConcatPath(b.BaseDir, "docs/kept")); err != nil {
+		t.Errorf("docs/kept: %v", err)
+	}
+}
+
+func TestDownloadDoesNotFollowSymlinks(t *testing.T) {
+	outside := t.TempDir()
+	target := ConcatPath(outside, "f")
+	if err := ioutil.WriteFile(target, []byte("outside"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	client := NewSurfstoreRPCClient(startTestServer(t), t.TempDir(), 4096)
+	client.Log = client.logger()
+	if err := os.Symlink(outside, ConcatPath(client.BaseDir, "d")); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, remoteMeta := range []*FileMetaData{
+		{Filename: "d/f", Version: 2, BlockHashList: []string{"0"}},
+		{Filename: "d/f", Version: 1, BlockHashList: []string{GetBlockHashString([]byte("new"))}, Size: 3},
+	} {
+		if err := download(client, remoteMeta, &FileMetaData{}); ErrorKind(err) != ERR_LOCAL_IO {
+			t.Errorf("download of %v: got %v, want a %v error", remoteMeta, err, ERR_LOCAL_IO)
+		}
+	}
+	if content, err := ioutil.ReadFile(target); err != nil || string(content) != "outside" {
+		t.Errorf("file outside the base directory = %q, %v", content, err)
+	}
+}
+
+func TestAtomicRenameOntoTombstone(t *testing.T) {
+	addr := startTestServer(t)
+	a := NewSurfstoreRPCClient(addr, t.TempDir(), 4096)
+	a.Atomic = true
+	b := NewSurfstoreRPCClient(addr, t.TempDir(), 4096)
+	sync := func(client RPCClient) *SyncResult {
+		t.Helper()
+		result, err := ClientSync(client)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return result
+	}
+	if err := ioutil.WriteFile(ConcatPath(a.BaseDir, "old"), []byte("content"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	sync(a)
+	sync(b)
+	// Leave a tombstone at version 3 on the new name, which client a never saw
+	for _, content := range []string{"first", "second"} {
+		if err := ioutil.WriteFile(ConcatPath(b.BaseDir, "new"), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		sync(b)
+	}
+	if err := os.Remove(ConcatPath(b.BaseDir, "new")); err != nil {
+		t.Fatal(err)
+	}
+	sync(b)
+
+	if err := os.Rename(ConcatPath(a.BaseDir, "old"), ConcatPath(a.BaseDir, "new")); err != nil {
+		t.Fatal(err)
+	}
+	if result := sync(a); result.Plan.Count(ACTION_RENAME_REMOTE) != 1 {
+		t.Fatalf("plan = %+v, want a remote rename", result.Plan.Actions)
+	}
+	remoteIndex := make(map[string]*FileMetaData)
+	if err := a.GetFileInfoMap(&remoteIndex); err != nil {
+		t.Fatal(err)
+	}
+	if moved := remoteIndex["new"]; moved.Version != 4 || IsDeleted(moved.BlockHashList) {
+		t.Errorf("new = %v, want version 4 past the tombstone", moved)
+	}
+	if old := remoteIndex["old"]; old.Version != 2 || old.RenamedTo != "new" {
+		t.Errorf("old = %v, want a version 2 tombstone renamed to new", old)
+	}
+	localIndex, err := LoadMetaFromMetaFile(a.BaseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if localIndex["new"].Version != 4 {
+		t.Errorf("local index version of new = %v, want 4", localIndex["new"].Version)
+	}
+
+	if result := sync(b); result.Plan.Count(ACTION_RENAME_LOCAL) != 1 {
+		t.Errorf("plan = %+v, want a local rename", result.Plan.Actions)
+	}
+	if content, err := ioutil.ReadFile(ConcatPath(b.BaseDir, "new")); err != nil || string(content) != "content" {
+		t.Errorf("new on the other client = %q, %v", content, err)
+	}
+}
+
+func TestClientSyncSkipsNamesTheIndexCannotHold(t *testing.T) {
+	client := NewSurfstoreRPCClient(startTestServer(t), t.TempDir(), 4096)
+	for _, fileName := range []string{"a,b", "line\nbreak", "dir,x/f", "ok"} {
+		if err := os.MkdirAll(filepath.Dir(ConcatPath(client.BaseDir, fileName)), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(ConcatPath(client.BaseDir, fileName), []byte("x"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if _, err := ClientSync(client); err != nil {
+		t.Fatal(err)
+	}
+
+	remoteIndex := make(map[string]*FileMetaData)
+	if err := client.GetFileInfoMap(&remoteIndex); err != nil {
+		t.Fatal(err)
+	}
+	if len(remoteIndex) != 1 || remoteIndex["ok"] == nil {
+		t.Errorf("server has %v, want only ok", sortedKeys(remoteIndex))
+	}
+	for _, fileName := range []string{"a,b", "line\nbreak", "cr\rname"} {
+		if status.Code(validateFilename(fileName)) != codes.InvalidArgument {
+			t.Errorf("validateFilename(%q) accepted it", fileName)
+		}
+	}
+}
+
+func TestGetBlockNotFound(t *testing.T) {
+	hash := GetBlockHashString([]byte("missing"))
+	_, err := NewBlockStore().GetBlock(context.Background(), &BlockHash{Hash: hash})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("GetBlock of a missing block: got %v, want NotFound", err)
+	}
+	if isTransient(err) {
+		t.Errorf("a missing block is retried")
+	}
+}
+
+func TestFailedDownloadLeavesNoPartialFile(t *testing.T) {
+	client := NewSurfstoreRPCClient(startTestServer(t), t.TempDir(), 4096)
+	client.Log = client.logger()
+	client.Retry = nil
+	// Neither journaled nor on the block store
+	remoteMeta := &FileMetaData{Filename: "f", Version: 1, BlockHashList: []string{GetBlockHashString([]byte("missing"))}, Size: 7}
+
+	if err := download(client, remoteMeta, &FileMetaData{}); ErrorKind(err) != ERR_NETWORK {
+		t.Fatalf("download of a missing block: got %v, want a %v error", err, ERR_NETWORK)
+	}
+	entries, err := ioutil.ReadDir(client.BaseDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, entry := range entries {
+		t.Errorf("%v was left in the base directory", entry.Name())
+	}
+}
+
+// BenchmarkClientSyncScan syncs a base directory of many large files that
+// are already on the server, so the time goes to scanning it: once trusting
+// the size, mtime and inode recorded in the local index, once hashing every file.
+func BenchmarkClientSyncScan(b *testing.B) {
+	const files = 32
+	const fileSize = 1 << 20
+	const blockSize = 64 << 10
+
+	baseDir := b.TempDir()
+	data := make([]byte, fileSize)
+	for i := 0; i < files; i++ {
+		if _, err := rand.Read(data); err != nil {
+			b.Fatal(err)
+		}
+		if err := ioutil.WriteFile(ConcatPath(baseDir, fmt.Sprintf("file%02d.bin", i)), data, 0644); err != nil {
+			b.Fatal(err)
+		}
+	}
+	client := NewSurfstoreRPCClient(startTestServer(b), baseDir, blockSize)
+	if _, err := ClientSync(client); err != nil {
+		b.Fatal(err)
+	}
+
+	for _, rehash := range []bool{false, true} {
+		name := "cached"
+		if rehash {
+			name = "rehash"
+		}
+		b.Run(name, func(b *testing.B) {
+			client.Rehash = rehash
+			b.SetBytes(files * fileSize)
+			for i := 0; i < b.N; i++ {
+				if _, err := ClientSync(client); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,103 @@
+package surfstore
+
+import (
+	"strings"
+	"unicode/utf8"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// invalidArgument is the error every malformed request is rejected with
+func invalidArgument(format string, args ...interface{}) error {
+	return status.Errorf(codes.InvalidArgument, format, args...)
+}
+
+// validateFilename checks that a filename is a relative, slash separated path
+// inside the base directory that clients sync rather than keep to themselves
+func validateFilename(fileName string) error {
+	switch {
+	case fileName == "":
+		return invalidArgument("filename is empty")
+	case len(fileName) > MAX_FILENAME_LENGTH:
+		return invalidArgument("filename is longer than %v bytes", MAX_FILENAME_LENGTH)
+	case !utf8.ValidString(fileName) || strings.ContainsRune(fileName, 0):
+		return invalidArgument("filename %q is not valid UTF-8 text", fileName)
+	case strings.ContainsAny(fileName, CONFIG_DELIMITER+"\n\r"):
+		// The index, journal and rules files are comma separated lines
+		return invalidArgument("filename %q has a comma or a line break", fileName)
+	case strings.HasPrefix(fileName, "/"):
+		return invalidArgument("filename %q is an absolute path", fileName)
+	case isReservedFile(fileName):
+		return invalidArgument("filename %q is reserved for client bookkeeping", fileName)
+	}
+	for _, element := range strings.Split(fileName, "/") {
+		if element == "" || element == "." || element == ".." {
+			return invalidArgument("filename %q has an empty, . or .. element", fileName)
+		}
+		if len(element) > MAX_PATH_ELEMENT_LENGTH {
+			return invalidArgument("filename %q has an element longer than %v bytes", fileName, MAX_PATH_ELEMENT_LENGTH)
+		}
+	}
+	return nil
+}
+
+// validateHash checks that a block hash is a hex encoded SHA-256 sum
+func validateHash(hash string) error {
+	if !isHex(hash) || len(hash) != 64 {
+		return invalidArgument("%q is not a block hash", hash)
+	}
+	return nil
+}
+
+// isHex reports whether s is lowercase hex, as hex.EncodeToString writes it
+func isHex(s string) bool {
+	if len(s)%2 != 0 {
+		return false
+	}
+	for i := 0; i < len(s); i++ {
+		if !('0' <= s[i] && s[i] <= '9' || 'a' <= s[i] && s[i] <= 'f') {
+			return false
+		}
+	}
+	return true
+}
+
+// validateFileMeta checks a file entry sent to the MetaStore. The hash list is
+// a tombstone, empty for an empty file, or block hashes; the encryption key
+// record holds a salt and a check value instead.
+func validateFileMeta(fileMetaData *FileMetaData) error {
+	if err := validateFilename(fileMetaData.Filename); err != nil {
+		return err
+	}
+	if fileMetaData.Version < 1 {
+		return invalidArgument("%v: version %v is not positive", fileMetaData.Filename, fileMetaData.Version)
+	}
+	if fileMetaData.Size < 0 {
+		return invalidArgument("%v: size %v is negative", fileMetaData.Filename, fileMetaData.Size)
+	}
+	if _, ok := FileType_name[int32(fileMetaData.FileType)]; !ok {
+		return invalidArgument("%v: unknown file type %v", fileMetaData.Filename, fileMetaData.FileType)
+	}
+	if fileMetaData.RenamedTo != "" {
+		if err := validateFilename(fileMetaData.RenamedTo); err != nil {
+			return err
+		}
+	}
+	if IsDeleted(fileMetaData.BlockHashList) {
+		return nil
+	}
+	if fileMetaData.Filename == ENCRYPTION_KEY_FILENAME {
+		hashes := fileMetaData.BlockHashList
+		if len(hashes) != 2 || !isHex(hashes[0]) || !isHex(hashes[1]) {
+			return invalidArgument("malformed encryption key record")
+		}
+		return nil
+	}
+	for _, hash := range fileMetaData.BlockHashList {
+		if err := validateHash(hash); err != nil {
+			return status.Errorf(codes.InvalidArgument, "%v: %v", fileMetaData.Filename, status.Convert(err).Message())
+		}
+	}
+	return nil
+}